@@ -0,0 +1,3 @@
+module github.com/andkrau/pmf2bin
+
+go 1.18
@@ -0,0 +1,199 @@
+package pmf
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// SwapSamples converts 16-bit audio samples between big- and little-endian
+// in place by swapping every pair of bytes. It panics if data has an odd
+// length, which would leave a byte unswapped and every later sample shifted.
+func SwapSamples(data []byte) {
+	if len(data)%2 != 0 {
+		panic(fmt.Sprintf("odd audio buffer length %d", len(data)))
+	}
+	for i := 0; i < len(data); i += 2 {
+		data[i], data[i+1] = data[i+1], data[i]
+	}
+}
+
+// hasAudio reports whether any of tracks is an audio track.
+func hasAudio(tracks []Track) bool {
+	for _, t := range tracks {
+		if t.Mode == 4 {
+			return true
+		}
+	}
+	return false
+}
+
+// detectByteOrder reports whether the audio of a disc without an
+// AUDIO_BYTE_ORDER directive is big-endian by sampling it in the PMF.
+// Detection needs random access, so it only happens when pmf is a file or
+// held in memory (see randomAccess); otherwise, or when the samples are
+// inconclusive, the default of little-endian is returned.
+func detectByteOrder(pmf io.Reader, tracks []Track) bool {
+	if r, size, ok := randomAccess(pmf); ok {
+		if msb, ok := guessAudioMSB(r, size, tracks); ok {
+			order := "AUDIO_LSB"
+			if msb {
+				order = "AUDIO_MSB"
+			}
+			Warn.Printf("no AUDIO_BYTE_ORDER directive; audio samples look like %s", order)
+			return msb
+		}
+	}
+	Warn.Printf("no AUDIO_BYTE_ORDER directive and the byte order could not be detected; assuming AUDIO_LSB")
+	return false
+}
+
+// randomAccess returns pmf as an io.ReaderAt along with its size when it is
+// a file or has a Size method, like a *bytes.Reader; ok is false otherwise.
+func randomAccess(pmf io.Reader) (r io.ReaderAt, size int64, ok bool) {
+	switch p := pmf.(type) {
+	case *os.File:
+		fi, err := p.Stat()
+		if err != nil {
+			return nil, 0, false
+		}
+		return p, fi.Size(), true
+	case interface {
+		io.ReaderAt
+		Size() int64
+	}:
+		return p, p.Size(), true
+	}
+	return nil, 0, false
+}
+
+// guessAudioMSB reads a stretch from the middle of each audio track in r, a
+// PMF of size bytes, and reports whether the 16-bit samples are smoother
+// when read big-endian, as real audio changes little from one sample to the
+// next while the wrong byte order turns it into noise. ok is false when the
+// audio is too quiet, or its position in the PMF unknown, to tell.
+func guessAudioMSB(r io.ReaderAt, size int64, tracks []Track) (msb, ok bool) {
+	var le, be float64
+	offsets := trackOffsets(size, tracks)
+	buf := make([]byte, 32*BinSector)
+	for i, t := range tracks {
+		start := offsets[i]
+		if t.Mode != 4 || start < 0 {
+			continue
+		}
+
+		sectors := t.End - t.Start + 1
+		n := len(buf)
+		if sectors*BinSector < n {
+			n = sectors * BinSector
+		}
+		pos := start + int64(sectors/2)*BinSector
+		if pos+int64(n) > start+int64(sectors)*BinSector {
+			pos = start
+		}
+		m, _ := r.ReadAt(buf[:n], pos)
+		l, b := sampleRoughness(buf[:m])
+		le += l
+		be += b
+	}
+
+	switch {
+	case be*1.5 < le:
+		return true, true
+	case le*1.5 < be:
+		return false, true
+	}
+	return false, false
+}
+
+// sampleRoughness sums the differences between consecutive samples of the
+// same channel in interleaved 16-bit stereo data, read little-endian and
+// big-endian.
+func sampleRoughness(data []byte) (le, be float64) {
+	for i := 4; i+1 < len(data); i += 2 {
+		l := int(int16(uint16(data[i])|uint16(data[i+1])<<8)) - int(int16(uint16(data[i-4])|uint16(data[i-3])<<8))
+		b := int(int16(uint16(data[i])<<8|uint16(data[i+1]))) - int(int16(uint16(data[i-4])<<8|uint16(data[i-3])))
+		if l < 0 {
+			l = -l
+		}
+		if b < 0 {
+			b = -b
+		}
+		le += float64(l)
+		be += float64(b)
+	}
+	return le, be
+}
+
+// trackOffsets returns the byte offset of each track in a PMF of the given
+// size, or -1 where it cannot be known. Form 2 sectors make the offset of
+// tracks after Mode 2 data uncertain, so such tracks are located from the end
+// of the file instead, as long as no Mode 2 data follows them.
+func trackOffsets(size int64, tracks []Track) []int64 {
+	exact := size == int64(ExpectedSize(tracks))
+	ends := make([]int64, len(tracks)+1) // bytes from each track to the end
+	mode2After := make([]bool, len(tracks)+1)
+	for i := len(tracks) - 1; i >= 0; i-- {
+		t := tracks[i]
+		ends[i] = ends[i+1] + int64(t.End-t.Start+1)*int64(pmfSectorSize(t.Mode))
+		mode2After[i] = mode2After[i+1] || t.Mode == 2
+	}
+
+	offsets := make([]int64, len(tracks))
+	var offset int64
+	mode2Before := false
+	for i, t := range tracks {
+		switch {
+		case exact || !mode2Before:
+			offsets[i] = offset
+		case !mode2After[i+1]:
+			offsets[i] = size - ends[i]
+		default:
+			offsets[i] = -1
+		}
+		offset += int64(t.End-t.Start+1) * int64(pmfSectorSize(t.Mode))
+		if t.Mode == 2 {
+			mode2Before = true
+		}
+	}
+	return offsets
+}
+
+// WriteAudioPreviews writes the first seconds of the first audio track in
+// the PMF read from r, of size bytes, as two WAV files: lsbPath with the
+// samples read as AUDIO_LSB and msbPath with them read as AUDIO_MSB.
+// Listening to both shows which byte order is right; the wrong one sounds
+// like loud static.
+func WriteAudioPreviews(r io.ReaderAt, size int64, tracks []Track, seconds int, lsbPath, msbPath string) error {
+	offsets := trackOffsets(size, tracks)
+	for i, t := range tracks {
+		if t.Mode != 4 {
+			continue
+		}
+		if offsets[i] < 0 {
+			return fmt.Errorf("track %d cannot be located in the PMF", t.Num)
+		}
+
+		sectors := t.End - t.Start + 1
+		if seconds*75 < sectors {
+			sectors = seconds * 75
+		}
+		buf := make([]byte, sectors*BinSector)
+		n, err := r.ReadAt(buf, offsets[i])
+		if n < len(buf) {
+			return fmt.Errorf("error reading track %d: %v", t.Num, err)
+		}
+
+		// WAV samples are little-endian, as stored for AUDIO_LSB
+		if err := writeWAV(lsbPath, buf); err != nil {
+			return err
+		}
+		SwapSamples(buf)
+		if err := writeWAV(msbPath, buf); err != nil {
+			return err
+		}
+		Info.Printf("Wrote %d sectors of track %d: %s, %s", sectors, t.Num, lsbPath, msbPath)
+		return nil
+	}
+	return fmt.Errorf("no audio tracks")
+}
@@ -0,0 +1,106 @@
+package pmf
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwapSamples(t *testing.T) {
+	data := make([]byte, BinSector)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	SwapSamples(data)
+	for i := 0; i < len(data); i += 2 {
+		if data[i] != byte((i+1)*7) || data[i+1] != byte(i*7) {
+			t.Fatalf("bytes %d-%d are % x, not swapped", i, i+1, data[i:i+2])
+		}
+	}
+}
+
+func TestSwapSamplesOddLength(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("SwapSamples accepted a 2351-byte buffer")
+		}
+	}()
+	SwapSamples(make([]byte, BinSector-1))
+}
+
+func TestWriteAudioPreviews(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "small.pmf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks, _, err := ParseFF(filepath.Join("testdata", "small.pmf.ff"), len(data), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "pmf-preview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lsb, msb := filepath.Join(dir, "lsb.wav"), filepath.Join(dir, "msb.wav")
+	if err := WriteAudioPreviews(bytes.NewReader(data), int64(len(data)), tracks, 5, lsb, msb); err != nil {
+		t.Fatal(err)
+	}
+	audio := data[len(data)-BinSector:]
+	for _, path := range []string{lsb, msb} {
+		wav, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(wav) != WAVHeaderSize+BinSector {
+			t.Fatalf("%s: %d bytes, want %d", filepath.Base(path), len(wav), WAVHeaderSize+BinSector)
+		}
+		if path == msb {
+			audio = append([]byte(nil), audio...)
+			SwapSamples(audio)
+		}
+		if !bytes.Equal(wav[WAVHeaderSize:], audio) {
+			t.Errorf("%s: samples differ from the PMF", filepath.Base(path))
+		}
+		if _, err := os.Stat(TempPath(path)); !os.IsNotExist(err) {
+			t.Errorf("%s left behind", filepath.Base(TempPath(path)))
+		}
+	}
+}
+
+// TestWriteBinTwiceAudioMSB converts the same AUDIO_MSB PMF buffer twice: the
+// byte swap must happen on a copy, so both images match and the buffer is
+// left as it was.
+func TestWriteBinTwiceAudioMSB(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "small.pmf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks, disc, err := ParseFF(filepath.Join("testdata", "small.pmf.ff"), len(data), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !disc.AudioMSB {
+		t.Fatal("small.pmf.ff does not declare AUDIO_MSB")
+	}
+	orig := append([]byte(nil), data...)
+
+	var first, second bytes.Buffer
+	opts := Options{Disc: disc}
+	if err := WriteBin(context.Background(), bytes.NewReader(data), tracks, &first, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteBin(context.Background(), bytes.NewReader(data), tracks, &second, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, orig) {
+		t.Error("the PMF buffer was modified")
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("the second image differs from the first")
+	}
+}
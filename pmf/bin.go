@@ -0,0 +1,499 @@
+package pmf
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// BuildBin writes the raw BIN image for the PMF data read from pmf and the
+// given track layout to outPath. The PMF is read sequentially, one sector at
+// a time, so memory use does not depend on the image size. Sectors are
+// encoded by opts.Workers goroutines and written in order.
+func BuildBin(pmf io.Reader, tracks []Track, outPath string, opts Options) error {
+	return BuildBinContext(context.Background(), pmf, tracks, outPath, opts)
+}
+
+// BuildBinContext is like BuildBin but stops when ctx is cancelled. The
+// context is checked every few hundred sectors; on cancellation ctx.Err() is
+// returned. The image is written to a temporary file next to outPath (see
+// TempPath) and renamed to outPath once complete, so a failed conversion
+// never leaves a half-written .bin behind or touches an existing one. On
+// error the temporary file is removed, unless opts.KeepPartial is set.
+func BuildBinContext(ctx context.Context, pmf io.Reader, tracks []Track, outPath string, opts Options) (err error) {
+	out, err := os.Create(TempPath(outPath))
+	if err != nil {
+		return ioError(err, "Failed to create %s: %v", TempPath(outPath), err)
+	}
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		closeErr := out.Close()
+		if err == nil && closeErr != nil {
+			err = ioError(closeErr, "Close failed: %v", closeErr)
+		}
+		err = finishTemp(outPath, err, opts.KeepPartial)
+		if err == nil {
+			Info.Printf("Wrote BIN image: %s", outPath)
+		}
+	}()
+	if err := WriteBin(ctx, pmf, tracks, out, opts); err != nil {
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		return ioError(err, "Sync failed: %v", err)
+	}
+	return nil
+}
+
+// TempPath returns the name output meant for path is written under until
+// it is complete: path with ".tmp" appended, in the same directory, so the
+// final rename stays on one filesystem and replaces path in one step. Images,
+// cue sheets and the other files written alongside them are all written this
+// way, flushed and synced before the rename, so a reader never finds a
+// half-written file under the real name.
+func TempPath(path string) string {
+	return path + ".tmp"
+}
+
+// finishTemp renames the temporary file of path into place if err is nil.
+// Otherwise the temporary file is removed, unless keep is set, and path is
+// left as it was.
+func finishTemp(path string, err error, keep bool) error {
+	if err == nil {
+		if renameErr := os.Rename(TempPath(path), path); renameErr != nil {
+			err = ioError(renameErr, "Failed to rename %s: %v", TempPath(path), renameErr)
+		}
+	}
+	if err != nil && !keep {
+		os.Remove(TempPath(path))
+	}
+	return err
+}
+
+// UpdateBin rewrites the BIN image at binPath, as left by an earlier
+// BuildBin of the same premaster, from image position opts.StartSector on,
+// leaving the sectors before it as they are. The file must already hold
+// them. The PMF is still read from the start, since the size of each Mode 2
+// sector is only known from its subheader, but nothing before the start
+// sector is encoded or written. The file is truncated to the new image
+// size. If ctx is cancelled the image is left partly updated.
+func UpdateBin(ctx context.Context, pmf io.Reader, tracks []Track, binPath string, opts Options) (err error) {
+	total := 0
+	for _, t := range tracks {
+		total += t.ImageSectors()
+	}
+	if opts.StartSector < 0 || opts.StartSector > total {
+		return fmt.Errorf("start sector %d out of range 0-%d", opts.StartSector, total)
+	}
+
+	out, err := os.OpenFile(binPath, os.O_RDWR, 0)
+	if err != nil {
+		return ioError(err, "Failed to open %s: %v", binPath, err)
+	}
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		closeErr := out.Close()
+		if err == nil && closeErr != nil {
+			err = ioError(closeErr, "Close failed: %v", closeErr)
+		}
+	}()
+
+	fi, err := out.Stat()
+	if err != nil {
+		return ioError(err, "Failed to stat %s: %v", binPath, err)
+	}
+	start := int64(opts.StartSector) * int64(opts.sectorSize())
+	if fi.Size() < start {
+		return fmt.Errorf("%s is %d bytes, too short to keep the %d sectors before sector %d", binPath, fi.Size(), opts.StartSector, opts.StartSector)
+	}
+	if _, err := out.Seek(start, io.SeekStart); err != nil {
+		return ioError(err, "Seek failed: %v", err)
+	}
+	if err := WriteBin(ctx, pmf, tracks, out, opts); err != nil {
+		return err
+	}
+	if err := out.Truncate(int64(total) * int64(opts.sectorSize())); err != nil {
+		return ioError(err, "Truncate failed: %v", err)
+	}
+
+	if err := out.Sync(); err != nil {
+		return ioError(err, "Sync failed: %v", err)
+	}
+
+	Info.Printf("Updated BIN image: %s from sector %d", binPath, opts.StartSector)
+	return nil
+}
+
+// WriteBin is like BuildBinContext but writes the BIN image to w, such as
+// standard output. The PMF size is not known up front when it comes from a
+// pipe, so a PMF that is too short or too long is only detected here.
+func WriteBin(ctx context.Context, pmf io.Reader, tracks []Track, w io.Writer, opts Options) error {
+	p := Pipeline{Workers: opts.Workers, BufferSectors: opts.BufferSectors}
+	return p.Run(ctx, pmf, tracks, w, opts)
+}
+
+// checkConsumed fails if the PMF continues past the last track, unless the
+// rest is padding accepted by opts.AllowTrailingPad.
+func checkConsumed(br *bufio.Reader, tracks []Track, opts Options) error {
+	n, zero, err := trailingBytes(br)
+	if err != nil {
+		return ioError(err, "error reading PMF: %v", err)
+	}
+	if n > 0 {
+		last := tracks[len(tracks)-1]
+		if !opts.AllowTrailingPad || !(zero || n%int64(pmfSectorSize(last.Mode)) == 0) {
+			return newError(ErrTrailingData, "PMF file not fully consumed: %d bytes remaining", n)
+		}
+		Warn.Printf("ignoring %d bytes of trailing padding in the PMF", n)
+	}
+	return nil
+}
+
+// trailingBytes consumes the rest of r and reports how many bytes were left
+// and whether they were all zero.
+func trailingBytes(r io.Reader) (n int64, zero bool, err error) {
+	zero = true
+	buf := make([]byte, 32*1024)
+	for {
+		m, err := r.Read(buf)
+		for _, b := range buf[:m] {
+			if b != 0 {
+				zero = false
+				break
+			}
+		}
+		n += int64(m)
+		if err == io.EOF {
+			return n, zero, nil
+		}
+		if err != nil {
+			return n, zero, err
+		}
+	}
+}
+
+// pregapSubheader is the subheader of generated Mode 2 pregap sectors: a
+// Form 1 data sector on file and channel 0.
+var pregapSubheader = [8]byte{0x00, 0x00, submodeData, 0x00, 0x00, 0x00, submodeData, 0x00}
+
+// sectorJob is one output sector: where it goes, what kind it is and the PMF
+// bytes it is built from.
+type sectorJob struct {
+	seq      int    // position in the output, used to restore order
+	lba      int    // absolute sector address (including the lead-in)
+	mode     int    // track mode
+	pregap   bool   // pregap sector, not backed by PMF data
+	blank    bool   // pregap sector with only sync and header, no EDC/ECC
+	scramble bool   // apply the CD scrambler to a data sector
+	swap     bool   // swap the bytes of the audio samples
+	edc      int    // position of the Form 1 EDC over PMF data, 0 if none
+	size     int    // number of PMF bytes in raw
+	patch    []byte // bytes to write over the EDC and parity, for protection
+	raw      [BinSector]byte
+	out      [BinSector]byte
+}
+
+// encode builds the 2352-byte output sector for j, scrambled if requested.
+func (j *sectorJob) encode() {
+	j.assemble()
+	if j.mode == 2 && !j.pregap && !IsForm2(j.raw[:8]) {
+		j.edc = 2072
+	}
+	if j.patch != nil {
+		copy(j.out[j.edcOffset():], j.patch)
+	}
+	if j.scramble && j.mode != 4 {
+		ScrambleSector(j.out[:])
+	}
+}
+
+// assemble builds the unscrambled 2352-byte sector in j.out.
+func (j *sectorJob) assemble() {
+	// checkCapacity keeps every address within an MSF address
+	header := sectorHeader(j.lba, j.mode)
+
+	if j.pregap {
+		var zero [PMFMode1Sector]byte
+		switch {
+		case j.mode == 4:
+			j.out = [BinSector]byte{} // digital silence
+		case j.blank:
+			j.out = [BinSector]byte{}
+			// 12-byte sync
+			copy(j.out[0:12], syncPattern[:])
+			// 4-byte header with accurate MSF
+			copy(j.out[12:16], header[:])
+			// Subheader, data and ECC remain zeros
+		case j.mode == 1:
+			j.out = EncodeMode1Sector(header[:], zero[:])
+		default:
+			j.out = EncodeMode2Form1Sector(header[:], pregapSubheader[:], zero[:])
+		}
+		return
+	}
+
+	var subheader []byte
+	data := j.raw[:j.size]
+	if j.mode == 2 {
+		subheader, data = j.raw[:8], j.raw[8:j.size]
+	}
+	out, err := EncodeSector(j.lba, j.mode, subheader, data)
+	if err != nil {
+		// readSectors sizes every job for its mode
+		panic(err)
+	}
+	j.out = out
+	if j.swap {
+		SwapSamples(j.out[:])
+	}
+}
+
+// readSectors walks the track layout in output order, reading the PMF data for
+// each sector, and hands every sector to emit as a new job. It stops early
+// with ctx.Err() once ctx is cancelled. With opts.Strict, a Mode 2 track
+// whose first sector does not look like XA data (see probeXA) or the first
+// Mode 2 sector with an implausible subheader stops it with an error, and
+// subheaders whose two copies differ draw a warning (or are repaired, with
+// opts.RepairSubheader). With opts.PadAudio, a short final sector of a final
+// audio track is zero-filled; with opts.PadMissing, so is every sector past
+// the end of a truncated PMF. Sectors before the image position
+// opts.StartSector are read but not emitted.
+func readSectors(ctx context.Context, br *bufio.Reader, tracks []Track, opts Options, emit func(j *sectorJob)) error {
+	offset := 0
+	count := 0
+	leadIn := opts.leadIn()
+
+	// read fills buf from the PMF, reporting where a short read happened
+	read := func(buf []byte) error {
+		n, err := io.ReadFull(br, buf)
+		offset += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return newError(ErrTruncated, "PMF truncated: need %d bytes, only %d available", offset-n+len(buf), offset)
+		}
+		if err != nil {
+			return ioError(err, "error reading PMF: %v", err)
+		}
+		return nil
+	}
+
+	// readSector reads the PMF data of sector s of track t, the i-th track
+	readSector := func(i int, t Track, s int) (*sectorJob, error) {
+		j := &sectorJob{lba: s + leadIn, mode: t.Mode, scramble: opts.Scramble}
+		j.swap = t.Mode == 4 && opts.AudioMSB != opts.outputAudioMSB()
+
+		switch t.Mode {
+		case 4:
+			j.size = BinSector
+			if opts.PadAudio && i == len(tracks)-1 && s == t.End {
+				n, err := io.ReadFull(br, j.raw[:BinSector])
+				offset += n
+				if err == io.ErrUnexpectedEOF {
+					// j.raw is zero past what was read
+					Info.Printf("Padded the final audio sector of track %d with %d zero bytes", t.Num, BinSector-n)
+				} else if err == io.EOF {
+					return nil, newError(ErrTruncated, "PMF truncated: need %d bytes, only %d available", offset+BinSector, offset)
+				} else if err != nil {
+					return nil, ioError(err, "error reading PMF: %v", err)
+				}
+				return j, nil
+			}
+		case 1:
+			j.size = PMFMode1Sector
+		default:
+			if err := read(j.raw[:8]); err != nil {
+				return nil, err
+			}
+			if opts.Strict && s == t.Start {
+				if err := probeXA(j.raw[:8]); err != nil {
+					return nil, newError(ErrMisaligned, "track %d does not start like Mode 2 (XA) data: %v; check its mode in the .pmf.ff", t.Num, err)
+				}
+			}
+			if (opts.Strict || opts.RepairSubheader) && !SubheaderCopiesMatch(j.raw[:8]) {
+				if opts.RepairSubheader {
+					Warn.Printf("sector %d (%s): subheader copies differ (% X); repaired from the first copy", s, LBAToMSFFormatted(s), j.raw[:8])
+					copy(j.raw[4:8], j.raw[0:4])
+				} else {
+					Warn.Printf("sector %d (%s): subheader copies differ (% X); the PMF may be corrupt", s, LBAToMSFFormatted(s), j.raw[:8])
+				}
+			}
+			if opts.Strict {
+				if err := CheckSubheader(j.raw[:8]); err != nil {
+					return nil, newError(ErrMisaligned, "sector %d (%s): %v", s, LBAToMSFFormatted(s), err)
+				}
+			}
+			// The form is decided per sector from the subheader, since XA
+			// tracks may interleave Form 1 and Form 2 sectors
+			j.size = PMFSector
+			if IsForm2(j.raw[:8]) {
+				j.size = PMFForm2Sector
+			}
+			if err := read(j.raw[8:j.size]); err != nil {
+				return nil, err
+			}
+			return j, nil
+		}
+
+		if err := read(j.raw[:j.size]); err != nil {
+			return nil, err
+		}
+		if t.Mode == 4 && s == t.Start && looksLikeMode2(j.raw[:BinSector]) {
+			// Reading on would misalign every later track
+			return nil, newError(ErrMisaligned, "track %d is declared as audio but starts with Mode 2 sector subheaders; check its mode in the .pmf.ff", t.Num)
+		}
+		return j, nil
+	}
+
+	missing := -1    // first sector past the end of a truncated PMF
+	synthesized := 0 // sectors zero-filled since
+
+	// Sectors before opts.StartSector are read but dropped
+	if opts.StartSector > 0 {
+		next := emit
+		skipped := 0
+		emit = func(j *sectorJob) {
+			if skipped < opts.StartSector {
+				skipped++
+				return
+			}
+			next(j)
+		}
+	}
+
+	// Patches go by position in the image, pregaps included
+	pos := 0
+	patched := 0
+	var patchErr error
+	if len(opts.Patches) > 0 {
+		next := emit
+		emit = func(j *sectorJob) {
+			if patch, ok := opts.Patches[pos]; ok && patchErr == nil {
+				if patchErr = j.checkPatch(pos, patch); patchErr == nil {
+					j.patch = patch
+					patched++
+				}
+			}
+			pos++
+			next(j)
+		}
+	}
+
+	for i, t := range tracks {
+		min, sec, frame := LBAToMSF(t.Start)
+		Info.Printf("Writing Track %d Type %s (%02d:%02d:%02d) Sectors %d–%d", t.Num, t.Type(), min, sec, frame, t.Start, t.End)
+
+		// Gap between sessions, left empty
+		for s := 0; s < t.SessionGap; s++ {
+			emit(&sectorJob{mode: 4, pregap: true})
+		}
+
+		// Pregap sectors
+		for s := 0; s < t.Pregap && !t.LogicalPregap; s++ {
+			emit(&sectorJob{lba: t.Start - t.Pregap + s + leadIn, mode: t.Mode, pregap: true, blank: opts.BlankPregap, scramble: opts.Scramble})
+		}
+
+		// Actual track sectors
+		for s := t.Start; s <= t.End; s++ {
+			// Checking every sector would be wasteful
+			if count++; count%256 == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+			if patchErr != nil {
+				return patchErr
+			}
+			if missing < 0 {
+				j, err := readSector(i, t, s)
+				if err == nil {
+					emit(j)
+					continue
+				}
+				if e, ok := err.(*Error); !ok || e.Kind != ErrTruncated || !opts.PadMissing {
+					return err
+				}
+				missing = s
+			}
+			// Built like a pregap sector: zero data with valid EDC/ECC,
+			// or silence
+			emit(&sectorJob{lba: s + leadIn, mode: t.Mode, pregap: true, scramble: opts.Scramble})
+			synthesized++
+		}
+	}
+	if synthesized > 0 {
+		Warn.Printf("PMF ended at sector %d (%s); zero-filled %d missing sectors", missing, LBAToMSFFormatted(missing), synthesized)
+	}
+	if patchErr != nil {
+		return patchErr
+	}
+	if patched < len(opts.Patches) {
+		Warn.Printf("%d of %d patches are for LBAs past the end of the image", len(opts.Patches)-patched, len(opts.Patches))
+	} else if patched > 0 {
+		Info.Printf("Patched the EDC of %d sectors", patched)
+	}
+	return nil
+}
+
+// progressWriter passes writes through to w, reporting the number of whole
+// sectors written after each one.
+type progressWriter struct {
+	w      io.Writer
+	n      int64
+	size   int64 // bytes per sector
+	total  int
+	report func(done, total int)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	p.report(int(p.n/p.size), p.total)
+	return n, err
+}
+
+// countingWriter passes writes through to w, counting the bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// edcStats counts the Mode 2 Form 1 sectors built from PMF data and how many
+// of them came out with a zero EDC. A zero EDC means the
+// subheader and data were all zero, which in more than a few sectors
+// suggests the PMF was read at the wrong offset.
+type edcStats struct {
+	sectors int
+	zero    int
+}
+
+func (s *edcStats) add(j *sectorJob) {
+	if j.edc == 0 || j.patch != nil {
+		return
+	}
+	s.sectors++
+	if j.out[j.edc]|j.out[j.edc+1]|j.out[j.edc+2]|j.out[j.edc+3] == 0 {
+		s.zero++
+	}
+}
+
+// report warns if the share of zero EDCs exceeds opts.ZeroEDCWarn.
+func (s *edcStats) report(opts Options) {
+	limit := opts.ZeroEDCWarn
+	if limit == 0 {
+		limit = DefaultZeroEDCWarn
+	}
+	if limit < 0 || s.sectors == 0 {
+		return
+	}
+	if pct := float64(s.zero) * 100 / float64(s.sectors); pct > limit {
+		Warn.Printf("%d of %d data sectors (%.1f%%) have a zero EDC, so their data is all zero; check the track offsets", s.zero, s.sectors, pct)
+	}
+}
@@ -0,0 +1,180 @@
+package pmf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ExtractPMF reverses BuildBin: it reads the track sectors (skipping pregaps)
+// of the BIN image at binPath and writes the premaster data to pmfPath.
+// Mode 2 sectors keep their subheader and user data (2056 bytes for Form 1,
+// 2332 bytes for Form 2), Mode 1 sectors their 2048 bytes of user data, and
+// audio sectors are copied whole. binMSB tells whether the image holds its
+// audio big-endian (see ParseCue), and msb whether the PMF is to; the samples
+// are byte-swapped when the two differ. Like the image of BuildBin, the PMF
+// is written to its temporary file (see TempPath) and renamed to pmfPath
+// once complete.
+func ExtractPMF(binPath string, tracks []Track, pmfPath string, binMSB, msb bool) (err error) {
+	in, err := os.Open(binPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", binPath, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(TempPath(pmfPath))
+	if err != nil {
+		return fmt.Errorf("Failed to create %s: %v", TempPath(pmfPath), err)
+	}
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		closeErr := out.Close()
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("Close failed: %v", closeErr)
+		}
+		err = finishTemp(pmfPath, err, false)
+		if err == nil {
+			Info.Printf("Wrote PMF: %s", pmfPath)
+		}
+	}()
+	bw := bufio.NewWriter(out)
+	var sector [BinSector]byte
+
+	for _, t := range tracks {
+		Info.Printf("Extracting Track %d Type %s Sectors %d–%d", t.Num, t.Type(), t.Start, t.End)
+		if _, err := in.Seek(int64(t.Start)*BinSector, io.SeekStart); err != nil {
+			return fmt.Errorf("Seek failed: %v", err)
+		}
+		br := bufio.NewReader(in)
+
+		for s := t.Start; s <= t.End; s++ {
+			if _, err := io.ReadFull(br, sector[:]); err != nil {
+				return fmt.Errorf("BIN truncated at sector %d: %v", s, err)
+			}
+
+			bw.Write(pmfData(sector[:], t.Mode, binMSB != msb))
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("Flush failed: %v", err)
+	}
+
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("Sync failed: %v", err)
+	}
+	return nil
+}
+
+// pmfData returns the part of an unscrambled BIN sector of a track of the
+// given mode that a PMF holds, as ExtractPMF writes it. Audio samples are
+// swapped in place first when swap is set.
+func pmfData(sector []byte, mode int, swap bool) []byte {
+	switch {
+	case mode == 4:
+		if swap {
+			SwapSamples(sector)
+		}
+		return sector
+	case mode == 1:
+		return sector[16:2064]
+	case IsForm2(sector[16:24]):
+		return sector[16:2348]
+	default:
+		return sector[16:2072]
+	}
+}
+
+// RoundTrip checks that ExtractPMF would give back the PMF read from pmf
+// from the image that BuildBin writes for it, without writing the image:
+// each sector is encoded in memory and its PMF data extracted again and
+// compared with what was read. It returns the number of sectors checked, or
+// an ErrRoundTrip error naming the first sector that comes back different.
+// Scrambling and patches, which BuildBin applies after encoding, are left
+// out.
+func RoundTrip(ctx context.Context, pmf io.Reader, tracks []Track, opts Options) (sectors int, err error) {
+	opts.Scramble, opts.Patches = false, nil
+	br := bufio.NewReader(pmf)
+
+	// Stop reading at the first sector that does not come back
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mismatch error
+	err = readSectors(ctx, br, tracks, opts, func(j *sectorJob) {
+		if mismatch != nil || j.pregap {
+			return
+		}
+		j.encode()
+		got, want := pmfData(j.out[:], j.mode, j.swap), j.raw[:j.size]
+		if !bytes.Equal(got, want) {
+			diff := fmt.Sprintf("%d bytes instead of %d", len(got), len(want))
+			if len(got) == len(want) {
+				at := 0
+				for got[at] == want[at] {
+					at++
+				}
+				diff = fmt.Sprintf("first difference at byte %d", at)
+			}
+			lba := j.lba - opts.leadIn()
+			mismatch = newError(ErrRoundTrip, "sector %d (%s) does not extract to its PMF data: %s", lba, LBAToMSFFormatted(lba), diff)
+			cancel()
+			return
+		}
+		sectors++
+	})
+	if mismatch != nil {
+		return sectors, mismatch
+	}
+	if err != nil {
+		return sectors, err
+	}
+	return sectors, checkConsumed(br, tracks, opts)
+}
+
+// WriteFF writes a .pmf.ff track table for tracks, declaring AUDIO_MSB or
+// AUDIO_LSB sample order depending on msb if there are audio tracks, and
+// marking gapless tracks. It is written to its temporary file and renamed
+// to ffPath once complete, as ExtractPMF does.
+func WriteFF(tracks []Track, ffPath string, msb bool) (err error) {
+	out, err := os.Create(TempPath(ffPath))
+	if err != nil {
+		return fmt.Errorf("Failed to create %s: %v", TempPath(ffPath), err)
+	}
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		closeErr := out.Close()
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("Close failed: %v", closeErr)
+		}
+		err = finishTemp(ffPath, err, false)
+		if err == nil {
+			Info.Printf("Wrote FF: %s", ffPath)
+		}
+	}()
+
+	if hasAudio(tracks) {
+		order := "AUDIO_LSB"
+		if msb {
+			order = "AUDIO_MSB"
+		}
+		fmt.Fprintf(out, "AUDIO_BYTE_ORDER: %s\n", order)
+	}
+	fmt.Fprintf(out, "%%NUMBER_OF_ADDED_TRACKS %d\n", len(tracks))
+	for _, t := range tracks {
+		if t.Gapless {
+			fmt.Fprintf(out, "%%GAPLESS %d\n", t.Num)
+		}
+	}
+	fmt.Fprintf(out, "%%START_OF_ADDED_TRACK_DATA\n")
+	for _, t := range tracks {
+		fmt.Fprintf(out, "%d %d %d %d\n", t.Num, t.Mode, t.Start, t.End)
+	}
+
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("Sync failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package pmf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// roundTrip converts the PMF data pmfData, laid out by the .pmf.ff ff, to a
+// BIN/CUE pair in dir with opts, then reads the cue sheet back with ParseCue
+// and extracts the PMF again with ExtractPMF, in the byte order declared by
+// the .pmf.ff. It returns the extracted PMF and the image's cue sheet.
+func roundTrip(t *testing.T, dir string, pmfData []byte, ff string, opts Options) (pmf, cue []byte) {
+	t.Helper()
+	tracks, disc, err := ParseFFReader(bytes.NewReader([]byte(ff)), len(pmfData), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Disc = disc
+	binPath, cuePath, pmfPath := filepath.Join(dir, "rt.bin"), filepath.Join(dir, "rt.cue"), filepath.Join(dir, "rt.pmf")
+	if err := BuildBin(bytes.NewReader(pmfData), tracks, binPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteCue(tracks, cuePath, "rt.bin", opts); err != nil {
+		t.Fatal(err)
+	}
+
+	gotBin, cueTracks, binMSB, err := ParseCue(cuePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotBin != binPath {
+		t.Fatalf("ParseCue found %s, want %s", gotBin, binPath)
+	}
+	if err := ExtractPMF(binPath, cueTracks, pmfPath, binMSB, disc.AudioMSB); err != nil {
+		t.Fatal(err)
+	}
+	if pmf, err = ioutil.ReadFile(pmfPath); err != nil {
+		t.Fatal(err)
+	}
+	if cue, err = ioutil.ReadFile(cuePath); err != nil {
+		t.Fatal(err)
+	}
+	return pmf, cue
+}
+
+func TestRoundTripKeepAudioMSB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmf-roundtrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pmfData, err := ioutil.ReadFile(filepath.Join("testdata", "small.pmf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ff, err := ioutil.ReadFile(filepath.Join("testdata", "small.pmf.ff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pmf, cue := roundTrip(t, dir, pmfData, string(ff), Options{KeepAudioMSB: true})
+	if !bytes.Contains(cue, []byte(`FILE "rt.bin" MOTOROLA`)) {
+		t.Errorf("cue sheet does not declare MOTOROLA:\n%s", cue)
+	}
+	if !bytes.Equal(pmf, pmfData) {
+		t.Error("extracted PMF differs from the original")
+	}
+}
+
+func TestRoundTripAudioOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmf-roundtrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	msbData, err := ioutil.ReadFile(filepath.Join("testdata", "small.pmf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msbFF, err := ioutil.ReadFile(filepath.Join("testdata", "small.pmf.ff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same premaster with its audio sector little-endian
+	lsbData := append([]byte(nil), msbData...)
+	SwapSamples(lsbData[len(lsbData)-BinSector:])
+	lsbFF := bytes.Replace(msbFF, []byte("AUDIO_MSB"), []byte("AUDIO_LSB"), 1)
+	lsbAudio := lsbData[len(lsbData)-BinSector:]
+
+	for _, in := range []struct {
+		order   string
+		pmf, ff []byte
+	}{
+		{"AUDIO_MSB", msbData, msbFF},
+		{"AUDIO_LSB", lsbData, lsbFF},
+	} {
+		for _, outMSB := range []bool{false, true} {
+			name := in.order + " to little-endian"
+			if outMSB {
+				name = in.order + " to big-endian"
+			}
+			pmf, cue := roundTrip(t, dir, in.pmf, string(in.ff), Options{OutputAudioMSB: outMSB})
+			if !bytes.Equal(pmf, in.pmf) {
+				t.Errorf("%s: extracted PMF differs from the original", name)
+			}
+			if got := bytes.Contains(cue, []byte(`FILE "rt.bin" MOTOROLA`)); got != outMSB {
+				t.Errorf("%s: FILE type MOTOROLA is %v, want %v:\n%s", name, got, outMSB, cue)
+			}
+
+			bin, err := ioutil.ReadFile(filepath.Join(dir, "rt.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := lsbAudio
+			if outMSB {
+				want = msbData[len(msbData)-BinSector:]
+			}
+			if !bytes.Equal(bin[len(bin)-BinSector:], want) {
+				t.Errorf("%s: audio in the image is in the wrong byte order", name)
+			}
+		}
+	}
+}
+
+// TestExtractPMFTruncated extracts from a BIN image shorter than its layout
+// over an existing PMF, which must be left as it was.
+func TestExtractPMFTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmf-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image, err := ioutil.ReadFile(filepath.Join("testdata", "small.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binPath, pmfPath := filepath.Join(dir, "small.bin"), filepath.Join(dir, "small.pmf")
+	if err := ioutil.WriteFile(binPath, image[:len(image)-BinSector], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pmfPath, []byte("old premaster"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tracks, _, err := parseFFString("%START_OF_ADDED_TRACK_DATA\n1 2 0 1\n2 4 2 2\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ExtractPMF(binPath, tracks, pmfPath, false, false); err == nil {
+		t.Fatal("extracted from a truncated image")
+	}
+	if got, err := ioutil.ReadFile(pmfPath); err != nil || string(got) != "old premaster" {
+		t.Errorf("small.pmf holds %d bytes (%v), want the old premaster", len(got), err)
+	}
+	if _, err := os.Stat(TempPath(pmfPath)); err == nil {
+		t.Error("temporary file left behind")
+	}
+}
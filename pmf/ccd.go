@@ -0,0 +1,102 @@
+package pmf
+
+import (
+	"fmt"
+	"os"
+)
+
+// WriteCCD writes a CloneCD control file describing the image of tracks: the
+// session's TOC entries (A0/A1/A2 and one per track) and the INDEX 0/1
+// positions of every track, with the catalog number and lead-in of opts.
+// Logical pregaps cannot be described, since a CloneCD image holds every
+// sector of the disc.
+func WriteCCD(tracks []Track, ccdPath string, opts Options) (err error) {
+	if tracks[len(tracks)-1].Session > 1 {
+		return fmt.Errorf("multi-session layouts are not supported in a .ccd")
+	}
+	for _, t := range tracks {
+		if t.LogicalPregap && t.Pregap > 0 {
+			return fmt.Errorf("track %d: logical pregaps cannot be described in a .ccd", t.Num)
+		}
+	}
+
+	out, err := os.Create(TempPath(ccdPath))
+	if err != nil {
+		return fmt.Errorf("Failed to create %s: %v", ccdPath, err)
+	}
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		closeErr := out.Close()
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("Close failed: %v", closeErr)
+		}
+		err = finishTemp(ccdPath, err, false)
+		if err == nil {
+			Info.Printf("Wrote CCD file: %s", ccdPath)
+		}
+	}()
+
+	first, last := tracks[0], tracks[len(tracks)-1]
+	leadIn := opts.leadIn()
+	discType := 0x00 // CD-DA or CD-ROM
+	for _, t := range tracks {
+		if t.Mode == 2 {
+			discType = 0x20 // CD-ROM XA
+		}
+	}
+
+	fmt.Fprintf(out, "[CloneCD]\nVersion=3\n\n")
+	fmt.Fprintf(out, "[Disc]\nTocEntries=%d\nSessions=1\nDataTracksScrambled=0\nCDTextLength=0\n", len(tracks)+3)
+	if opts.Catalog != "" {
+		fmt.Fprintf(out, "CATALOG=%s\n", opts.Catalog)
+	}
+	fmt.Fprintf(out, "\n[Session 1]\nPreGapMode=%d\nPreGapSubC=0\n", ccdMode(first.Mode))
+
+	// Points A0 (first track), A1 (last track) and A2 (lead-out), followed
+	// by the start of each track; P times are absolute, lead-in included
+	entry := 0
+	writeEntry := func(point int, control byte, pmin, psec, pframe int) {
+		fmt.Fprintf(out, "\n[Entry %d]\n", entry)
+		fmt.Fprintf(out, "Session=1\nPoint=0x%02x\nADR=0x01\nControl=0x%02x\nTrackNo=0\n", point, control)
+		fmt.Fprintf(out, "AMin=0\nASec=0\nAFrame=0\nALBA=%d\nZero=0\n", -leadIn)
+		fmt.Fprintf(out, "PMin=%d\nPSec=%d\nPFrame=%d\nPLBA=%d\n", pmin, psec, pframe, MSFToLBA(pmin, psec, pframe)-leadIn)
+		entry++
+	}
+	writeEntry(0xa0, ccdControl(first), first.Num, discType, 0)
+	writeEntry(0xa1, ccdControl(last), last.Num, 0, 0)
+	min, sec, frame := LBAToMSF(DiscTOC(tracks, opts).LeadOut + leadIn)
+	writeEntry(0xa2, ccdControl(last), min, sec, frame)
+	for _, t := range tracks {
+		min, sec, frame := LBAToMSF(t.Start + leadIn)
+		writeEntry(t.Num, ccdControl(t), min, sec, frame)
+	}
+
+	for _, t := range tracks {
+		fmt.Fprintf(out, "\n[TRACK %d]\nMODE=%d\n", t.Num, ccdMode(t.Mode))
+		if t.ISRC != "" {
+			fmt.Fprintf(out, "ISRC=%s\n", t.ISRC)
+		}
+		if t.Pregap > 0 || t.Gapless {
+			fmt.Fprintf(out, "INDEX 0=%d\n", t.Start-t.Pregap)
+		}
+		fmt.Fprintf(out, "INDEX 1=%d\n", t.Start)
+	}
+
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("Sync failed: %v", err)
+	}
+	return nil
+}
+
+// ccdMode returns the CloneCD track mode: 0 for audio, otherwise the data mode.
+func ccdMode(mode int) int {
+	return modeOf(mode).ccdMode
+}
+
+// ccdControl returns the Q control nibble of a track: 4 for data, 0 for audio.
+func ccdControl(t Track) byte {
+	if t.Mode == 4 {
+		return 0x00
+	}
+	return 0x04
+}
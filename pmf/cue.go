@@ -0,0 +1,486 @@
+package pmf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// WriteCue writes a CUE sheet for tracks that references the BIN image binName.
+// The disc's catalog number, title and performer, from opts.Disc, and each
+// track's title, performer and ISRC are included when set. Index times
+// are positions in the image, starting at 00:00:00, unless opts.CueLeadIn is
+// set.
+func WriteCue(tracks []Track, cuePath, binName string, opts Options) error {
+	return writeCue(tracks, cuePath, []string{binName}, opts)
+}
+
+// WriteSplitCue writes a CUE sheet for an image split by BuildSplitBin, with
+// one FILE per track naming the corresponding entry of binNames, or one per
+// run of consecutive tracks with the same name. Index times are relative to
+// the start of each file, so a track's pregap is its file's INDEX 00 (or a
+// PREGAP, if logical) when it starts a file.
+func WriteSplitCue(tracks []Track, cuePath string, binNames []string, opts Options) error {
+	if len(binNames) != len(tracks) {
+		return fmt.Errorf("%d file names for %d tracks", len(binNames), len(tracks))
+	}
+	return writeCue(tracks, cuePath, binNames, opts)
+}
+
+// writeCue writes the CUE sheet for WriteCue (one name in binNames) or
+// WriteSplitCue (one name per track).
+func writeCue(tracks []Track, cuePath string, binNames []string, opts Options) (err error) {
+	out, err := os.Create(TempPath(cuePath))
+	if err != nil {
+		return fmt.Errorf("Failed to write cue: %v", err)
+	}
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		closeErr := out.Close()
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("Close failed: %v", closeErr)
+		}
+		err = finishTemp(cuePath, err, opts.KeepPartial)
+		if err == nil {
+			Info.Printf("Wrote CUE sheet: %s", cuePath)
+		}
+	}()
+
+	bw := bufio.NewWriter(out)
+	if err := WriteCueTo(bw, tracks, binNames, opts); err != nil {
+		return fmt.Errorf("Failed to write cue: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("Flush failed: %v", err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("Sync failed: %v", err)
+	}
+	return nil
+}
+
+// WriteCueTo writes the text of the CUE sheet that WriteCue (one name in
+// binNames) or WriteSplitCue (one name per track) would write to w, for
+// example to learn its size without creating a file.
+func WriteCueTo(w io.Writer, tracks []Track, binNames []string, opts Options) error {
+	if len(binNames) != 1 && len(binNames) != len(tracks) {
+		return fmt.Errorf("%d file names for %d tracks", len(binNames), len(tracks))
+	}
+	out := &errWriter{w: w}
+	for _, rem := range opts.CueRem {
+		fmt.Fprintf(out, "REM %s\n", rem)
+	}
+	if opts.Catalog != "" {
+		fmt.Fprintf(out, "CATALOG %s\n", opts.Catalog)
+	}
+	if opts.Title != "" {
+		fmt.Fprintf(out, "TITLE \"%s\"\n", opts.Title)
+	}
+	if opts.Performer != "" {
+		fmt.Fprintf(out, "PERFORMER \"%s\"\n", opts.Performer)
+	}
+	split := len(binNames) > 1
+	starts := imageStarts(tracks)
+	leadIn := 0
+	if opts.CueLeadIn {
+		leadIn = opts.leadIn()
+	}
+	fileStart := 0   // image position of the current file's first sector
+	regionStart := 0 // image position of the current track's first sector
+	for i, t := range tracks {
+		if i == 0 || (split && binNames[i] != binNames[i-1]) {
+			fmt.Fprintf(out, "FILE \"%s\" %s\n", filepath.Base(binNames[i]), cueFileType(binNames, tracks, i, opts))
+			fileStart = regionStart
+		}
+		if split {
+			// Positions from here on are relative to this track's file
+			starts[i] -= fileStart
+			regionStart += t.ImageSectors()
+		}
+		if t.SessionGap > 0 || (i > 0 && t.Session != tracks[i-1].Session) {
+			fmt.Fprintf(out, "  REM SESSION %02d\n", t.Session)
+		}
+		trackType := modeOf(t.Mode).cueType
+		if opts.SubInterleaved {
+			trackType = modeOf(t.Mode).cueSub
+		}
+		fmt.Fprintf(out, "  TRACK %02d %s\n", t.Num, trackType)
+		if t.Title != "" {
+			fmt.Fprintf(out, "    TITLE \"%s\"\n", t.Title)
+		}
+		if t.Performer != "" {
+			fmt.Fprintf(out, "    PERFORMER \"%s\"\n", t.Performer)
+		}
+		if t.ISRC != "" {
+			fmt.Fprintf(out, "    ISRC %s\n", t.ISRC)
+		}
+
+		switch {
+		case t.Pregap > 0 && t.LogicalPregap:
+			fmt.Fprintf(out, "    PREGAP %s\n", LBAToMSFFormatted(t.Pregap))
+		case t.Pregap > 0, t.Gapless:
+			min, sec, frame := LBAToMSF(starts[i] - t.Pregap + leadIn)
+			fmt.Fprintf(out, "    INDEX 00 %02d:%02d:%02d\n", min, sec, frame)
+		}
+		fmt.Fprintf(out, "    INDEX 01 %s\n", LBAToMSFFormatted(starts[i]+leadIn))
+	}
+	return out.err
+}
+
+// cueFileType returns the FILE type of binNames[i], the file starting with
+// tracks[i]: WAVE for a .wav file, MOTOROLA for a raw file holding
+// big-endian audio (see Options.OutputAudioMSB), and BINARY otherwise. Data
+// sectors have no byte order, so a file mixing them with big-endian audio
+// is MOTOROLA too; readers only swap the audio tracks.
+func cueFileType(binNames []string, tracks []Track, i int, opts Options) string {
+	name := binNames[0]
+	if len(binNames) > 1 {
+		name = binNames[i]
+	}
+	if strings.EqualFold(filepath.Ext(name), ".wav") {
+		return "WAVE"
+	}
+	if !opts.outputAudioMSB() {
+		return "BINARY"
+	}
+	for ; i < len(tracks); i++ {
+		if len(binNames) > 1 && binNames[i] != name {
+			break
+		}
+		if tracks[i].Mode == 4 {
+			return "MOTOROLA"
+		}
+	}
+	return "BINARY"
+}
+
+// errWriter passes writes through to w until one fails, then keeps the
+// error and ignores the rest, so a series of Fprintf calls needs one check.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err := e.w.Write(p)
+	e.err = err
+	return n, err
+}
+
+// ParseCue reads a single-FILE CUE sheet, such as one written by WriteCue, and
+// returns the path of the referenced BIN image and its track layout. Each
+// track ends just before the next track's INDEX 00 (or INDEX 01); the last
+// track ends at the end of the BIN image. audioMSB reports whether the image
+// holds its audio big-endian, as a FILE of type MOTOROLA declares.
+func ParseCue(cuePath string) (binPath string, tracks []Track, audioMSB bool, err error) {
+	sheet, err := readCue(cuePath, false)
+	if err != nil {
+		return "", nil, false, err
+	}
+	tracks = sheet.tracks
+
+	binPath = sheet.binName
+	if !filepath.IsAbs(binPath) {
+		binPath = filepath.Join(filepath.Dir(cuePath), sheet.binName)
+	}
+	fi, err := os.Stat(binPath)
+	if err != nil {
+		return "", nil, false, fmt.Errorf("failed to stat %s: %v", binPath, err)
+	}
+	if fi.Size()%BinSector != 0 {
+		return "", nil, false, fmt.Errorf("%s is not a whole number of %d-byte sectors", binPath, BinSector)
+	}
+	binSectors := int(fi.Size() / BinSector)
+
+	for i := range tracks {
+		t := &tracks[i]
+		if sheet.index00[i] >= 0 {
+			t.Pregap = t.Start - sheet.index00[i]
+			t.Gapless = t.Pregap == 0
+		}
+		if i+1 < len(tracks) {
+			next := tracks[i+1].Start
+			if sheet.index00[i+1] >= 0 {
+				next = sheet.index00[i+1]
+			}
+			t.End = next - 1
+		} else {
+			t.End = binSectors - 1
+		}
+		if t.End < t.Start {
+			return "", nil, false, fmt.Errorf("track %d has no sectors", t.Num)
+		}
+	}
+
+	return binPath, tracks, sheet.binMSB, nil
+}
+
+// ParseCueLayout reads the track layout of a PMF from a CUE sheet instead of
+// a .pmf.ff, for premasters whose track table is lost. Each track's mode
+// comes from its TRACK type, and its pregap and start from INDEX 00 and
+// INDEX 01 (or PREGAP), read as positions in an image that begins at sector
+// 0, as WriteCue writes them. The FILE the sheet names is not used. The
+// audio byte order is taken from a "REM AUDIO_BYTE_ORDER" line, as pmf2bin
+// writes it, or else detected, and returned in the Disc.
+//
+// The last track runs to the end of the PMF, so pmfLen must be known. Mode 2
+// sectors take more room in the PMF if they are Form 2, so where the last
+// track starts in the PMF, and how many sectors a Mode 2 last track has, are
+// found by reading the subheaders from pmf. If pmf is nil, every Mode 2
+// sector is taken to be Form 1. The layout is then validated like a .pmf.ff
+// by ParseFF.
+func ParseCueLayout(cuePath string, pmf io.ReaderAt, pmfLen int, opts Options) ([]Track, Disc, error) {
+	if pmfLen < 0 {
+		return nil, Disc{}, fmt.Errorf("the PMF size is needed to find the end of the last track in %s", cuePath)
+	}
+	sheet, err := readCue(cuePath, true)
+	if err != nil {
+		return nil, Disc{}, err
+	}
+	tracks := sheet.tracks
+	disc := Disc{AudioMSB: sheet.audioMSB, ByteOrderDeclared: sheet.byteOrder}
+
+	// Turn image positions into addresses, which logical pregaps move on,
+	// and note where each track's pregap begins
+	first := make([]int, len(tracks))
+	shift := 0
+	for i := range tracks {
+		t := &tracks[i]
+		index01 := t.Start
+		if sheet.pregap[i] >= 0 {
+			shift += sheet.pregap[i]
+		}
+		t.Start = index01 + shift
+		switch {
+		case sheet.index00[i] >= 0:
+			first[i] = t.Start - (index01 - sheet.index00[i])
+			t.Gapless = sheet.index00[i] == index01
+		case sheet.pregap[i] >= 0:
+			first[i] = t.Start - sheet.pregap[i]
+		default:
+			first[i] = t.Start
+		}
+	}
+
+	offset := 0 // of the current track in the PMF
+	for i := range tracks[:len(tracks)-1] {
+		t := &tracks[i]
+		t.End = first[i+1] - 1
+		if t.End < t.Start {
+			return nil, Disc{}, newError(ErrTrackRange, "track %d has no sectors", t.Num)
+		}
+		n, err := pmfBytes(pmf, offset, *t, t.End-t.Start+1)
+		if err != nil {
+			return nil, Disc{}, err
+		}
+		offset += n
+	}
+	last := &tracks[len(tracks)-1]
+	sectors := 0
+	if last.Mode == 2 && pmf != nil {
+		for offset < pmfLen {
+			n, err := pmfBytes(pmf, offset, *last, 1)
+			if err != nil {
+				return nil, Disc{}, err
+			}
+			offset += n
+			sectors++
+		}
+	} else {
+		sectors = (pmfLen - offset) / pmfSectorSize(last.Mode)
+	}
+	if sectors < 1 {
+		return nil, Disc{}, newError(ErrSizeMismatch, "PMF of %d bytes ends before track %d", pmfLen, last.Num)
+	}
+	last.End = last.Start + sectors - 1
+
+	// The gaps between the tracks become their pregaps
+	tracks, err = layoutTracks(tracks, nil, nil, pmfLen, disc, opts)
+	if err != nil {
+		return nil, Disc{}, err
+	}
+	return tracks, disc, nil
+}
+
+// pmfBytes returns the number of bytes that the given number of sectors of
+// track t take in the PMF from offset on. Mode 2 subheaders are read from
+// pmf to tell Form 2 sectors apart, unless pmf is nil.
+func pmfBytes(pmf io.ReaderAt, offset int, t Track, sectors int) (int, error) {
+	if t.Mode != 2 || pmf == nil {
+		return sectors * pmfSectorSize(t.Mode), nil
+	}
+	n := 0
+	var subheader [8]byte
+	for s := 0; s < sectors; s++ {
+		if _, err := pmf.ReadAt(subheader[:], int64(offset+n)); err != nil {
+			if err == io.EOF {
+				return 0, newError(ErrTruncated, "PMF truncated: track %d needs more than %d bytes", t.Num, offset+n)
+			}
+			return 0, ioError(err, "error reading PMF: %v", err)
+		}
+		if IsForm2(subheader[:]) {
+			n += PMFForm2Sector
+		} else {
+			n += PMFSector
+		}
+	}
+	return n, nil
+}
+
+// cueSheet is what readCue finds in a single-FILE CUE sheet.
+type cueSheet struct {
+	binName string
+	binMSB  bool    // FILE type MOTOROLA: the image holds big-endian audio
+	tracks  []Track // numbered from 1, with the mode and INDEX 01 (as Start)
+	index00 []int   // INDEX 00 position per track, -1 if absent
+	pregap  []int   // PREGAP length per track, -1 if absent
+
+	// REM AUDIO_BYTE_ORDER, as written by pmf2bin
+	audioMSB  bool
+	byteOrder bool
+}
+
+// readCue reads the FILE, TRACK, INDEX and, if pregaps is set, PREGAP
+// commands of a single-FILE CUE sheet, checking that every track is
+// numbered in turn and has an INDEX 01 after any INDEX 00.
+func readCue(cuePath string, pregaps bool) (sheet cueSheet, err error) {
+	f, err := os.Open(cuePath)
+	if err != nil {
+		return sheet, fmt.Errorf("failed to open %s: %v", cuePath, err)
+	}
+	defer f.Close()
+
+	lineNum := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "FILE":
+			if sheet.binName != "" {
+				return sheet, fmt.Errorf("line %d: only one FILE per cue sheet is supported", lineNum)
+			}
+			name, fileType := splitCueFile(strings.TrimSpace(line[len(fields[0]):]))
+			if name == "" {
+				return sheet, fmt.Errorf("line %d: missing file name", lineNum)
+			}
+			switch strings.ToUpper(fileType) {
+			case "BINARY":
+			case "MOTOROLA":
+				// Big-endian audio, as WriteCue declares it
+				sheet.binMSB = true
+			default:
+				return sheet, fmt.Errorf("line %d: unsupported FILE type %q", lineNum, fileType)
+			}
+			sheet.binName = name
+		case "TRACK":
+			if len(fields) < 3 {
+				return sheet, fmt.Errorf("line %d: malformed TRACK line", lineNum)
+			}
+			var t Track
+			t.Num, err = strconv.Atoi(fields[1])
+			if err != nil {
+				return sheet, fmt.Errorf("line %d: invalid track number %q", lineNum, fields[1])
+			}
+			mode, ok := modeForCueType(fields[2])
+			if !ok && isSubCueType(fields[2]) {
+				return sheet, newError(ErrSubchannelImage, "line %d: track type %q has 2448-byte sectors, which are not supported", lineNum, fields[2])
+			}
+			if !ok {
+				return sheet, fmt.Errorf("line %d: unsupported track type %q", lineNum, fields[2])
+			}
+			t.Mode = mode
+			t.Start = -1
+			sheet.tracks = append(sheet.tracks, t)
+			sheet.index00 = append(sheet.index00, -1)
+			sheet.pregap = append(sheet.pregap, -1)
+		case "INDEX":
+			if len(sheet.tracks) == 0 || len(fields) < 3 {
+				return sheet, fmt.Errorf("line %d: INDEX outside of a track", lineNum)
+			}
+			pos, err := parseMSF(fields[2])
+			if err != nil {
+				return sheet, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			switch fields[1] {
+			case "00", "0":
+				sheet.index00[len(sheet.tracks)-1] = pos
+			case "01", "1":
+				sheet.tracks[len(sheet.tracks)-1].Start = pos
+			}
+		case "PREGAP":
+			if !pregaps {
+				return sheet, fmt.Errorf("line %d: %s is not supported", lineNum, fields[0])
+			}
+			if len(sheet.tracks) == 0 || len(fields) < 2 {
+				return sheet, fmt.Errorf("line %d: PREGAP outside of a track", lineNum)
+			}
+			length, err := parseMSF(fields[1])
+			if err != nil {
+				return sheet, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			sheet.pregap[len(sheet.tracks)-1] = length
+		case "POSTGAP":
+			return sheet, fmt.Errorf("line %d: %s is not supported", lineNum, fields[0])
+		case "REM":
+			if len(fields) == 3 && fields[1] == "AUDIO_BYTE_ORDER" {
+				if fields[2] != "AUDIO_LSB" && fields[2] != "AUDIO_MSB" {
+					return sheet, fmt.Errorf("line %d: unknown AUDIO_BYTE_ORDER %q: expected AUDIO_LSB or AUDIO_MSB", lineNum, fields[2])
+				}
+				sheet.audioMSB = fields[2] == "AUDIO_MSB"
+				sheet.byteOrder = true
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return sheet, fmt.Errorf("error reading %s: %v", cuePath, err)
+	}
+
+	if sheet.binName == "" {
+		return sheet, fmt.Errorf("no FILE found in %s", cuePath)
+	}
+	if len(sheet.tracks) == 0 {
+		return sheet, fmt.Errorf("no tracks found in %s", cuePath)
+	}
+	for i, t := range sheet.tracks {
+		if t.Num != i+1 {
+			return sheet, fmt.Errorf("track numbering mismatch: got %d, expected %d", t.Num, i+1)
+		}
+		if t.Start < 0 {
+			return sheet, fmt.Errorf("track %d has no INDEX 01", t.Num)
+		}
+		if sheet.index00[i] > t.Start {
+			return sheet, fmt.Errorf("track %d INDEX 00 is after INDEX 01", t.Num)
+		}
+	}
+	return sheet, nil
+}
+
+// splitCueFile splits the arguments of a FILE command into the (optionally
+// quoted) file name and the file type.
+func splitCueFile(args string) (name, fileType string) {
+	if strings.HasPrefix(args, "\"") {
+		end := strings.LastIndex(args, "\"")
+		if end <= 0 {
+			return "", ""
+		}
+		return args[1:end], strings.TrimSpace(args[end+1:])
+	}
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		return "", ""
+	}
+	return fields[0], fields[1]
+}
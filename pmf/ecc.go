@@ -0,0 +1,282 @@
+package pmf
+
+import "fmt"
+
+var (
+	edcLUT [256]uint32
+	gfLog  [256]byte
+	gfPow  [509]byte
+
+	// mul2 and mul3 multiply by the LFSR feedback coefficients g₀ = 2 and
+	// g₁ = 3, saving the log/exp lookups of gfMult in the parity loops.
+	mul2 [256]byte
+	mul3 [256]byte
+)
+
+func init() {
+	// Create EDC Lookup table
+	const polyEDC uint32 = 0xD8018001 // reflected polynomial of 0x04C11DB7
+	for i := 0; i < 256; i++ {
+		r := uint32(i)
+		for j := 0; j < 8; j++ {
+			if r&1 != 0 {
+				r = (r >> 1) ^ polyEDC
+			} else {
+				r >>= 1
+			}
+		}
+		edcLUT[i] = r
+	}
+
+	// Creates the exponentiation (gfPow) and logarithm (gfLog) tables
+	// for the Galois Field GF(2^8), essential for Reed-Solomon arithmetic.
+	// The tables are generated using the irreducible polynomial: x^8 + x^4 + x^3 + x^2 + 1,
+	// which corresponds to the reduction value 0x11D.
+	// The process generates successive powers of the primitive element α (alpha).
+	//
+	// When b exceeds 8 bits, b ^= 0x11d reduces it by the irreducible polynomial.
+	// The second loop extends gfPow to 509 elements to avoid modulo 255
+	// operations during multiplication (optimization: gfPow[a+b] instead of gfPow[(a+b)%255]).
+	var b uint16 = 1
+	for i := 0; i < 255; i++ {
+		gfPow[i] = byte(b)
+		gfLog[b] = byte(i)
+		b <<= 1
+		if b&0x100 != 0 {
+			b ^= 0x11d
+		}
+	}
+	for i := 255; i < 509; i++ {
+		gfPow[i] = gfPow[i-255]
+	}
+
+	for i := 0; i < 256; i++ {
+		mul2[i] = gfMult(byte(i), 2)
+		mul3[i] = gfMult(byte(i), 3)
+	}
+}
+
+// ComputeEDC calculates the 32-bit EDC (Error Detection Code) over data, the
+// range of a raw sector that its mode covers:
+//
+//	Mode 1:        bytes 0-2063 (sync, header, data), stored at 2064-2067
+//	Mode 2 Form 1: bytes 16-2071 (subheader, data), stored at 2072-2075
+//	Mode 2 Form 2: bytes 16-2347 (subheader, data), stored at 2348-2351
+//
+// It uses a reflected CRC-32 with polynomial 0x04C11DB7 (reflected as 0xD8018001).
+// Unlike standard CRC-32, no initial or final XOR is applied, so all-zero
+// data has a zero EDC: a Mode 2 sector of zeroes has EDC 00 00 00 00, while
+// a Mode 1 sector of zeroes at 00:02:00 has C5 13 68 2B, from its sync and
+// header. SelfTest checks the latter against a value computed bit by bit.
+func ComputeEDC(data []byte) [4]byte {
+	var edc uint32 = 0
+
+	for _, b := range data {
+		// Standard reflected CRC-32: XOR byte with accumulator LSB,
+		// lookup precomputed value, XOR with shifted accumulator
+		index := byte(edc) ^ b
+		edc = (edc >> 8) ^ edcLUT[index]
+	}
+
+	// Return in little-endian byte order
+	return [4]byte{
+		byte(edc),
+		byte(edc >> 8),
+		byte(edc >> 16),
+		byte(edc >> 24),
+	}
+}
+
+// gfMult multiplies two non-zero bytes in GF(2^8) using precomputed logarithm tables.
+// Uses the property: a * b = exp(log(a) + log(b)) modulo 255 in GF(2^8).
+// Returns 0 if either input is 0.
+func gfMult(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfPow[int(gfLog[a])+int(gfLog[b])]
+}
+
+// PParityLFSR is the CD-ROM Mode 2 Form 1 P-Parity Generator using a 2-stage LFSR.
+//
+// Instead of computing the parity formula directly, we simulate a shift register
+// that processes sector data sequentially. The feedback taps correspond to the
+// generator polynomial coefficients.
+//
+// For P-parity (2 parity bytes), the generator polynomial is:
+//
+//	g(x) = x² + g₁x + g₀
+//
+// over GF(2⁸) with the standard CD-ROM field polynomial 0x11d.
+// Feedback coefficients for the LFSR are g₀ = 2 and g₁ = 3.
+//
+// Input:  2064 bytes (header + subheader + data + EDC, header bytes treated as 0)
+// Output: 172 bytes organized as:
+//
+//	Bytes 0-85:   r1 values for all 43 columns (LSB, MSB pairs)
+//	Bytes 86-171: r0 values for all 43 columns (LSB, MSB pairs)
+//
+// It returns an error if sector is not 2064 bytes long.
+func PParityLFSR(sector []byte) ([]byte, error) {
+	parity := make([]byte, 172)
+	if err := pParity(parity, sector, true); err != nil {
+		return nil, err
+	}
+	return parity, nil
+}
+
+// PParityInto is like PParityLFSR but writes the 172 parity bytes to dst,
+// which may be the P-parity field of the sector itself, without allocating.
+// It returns an error if dst or sector has the wrong length.
+func PParityInto(dst, sector []byte) error {
+	return pParity(dst, sector, true)
+}
+
+// pParity computes P-parity into parity, optionally treating the 4 header
+// bytes as zero (Mode 2) or including them (Mode 1).
+func pParity(parity, sector []byte, zeroHeader bool) error {
+	if len(sector) != 2064 {
+		return fmt.Errorf("sector wrong size: need 2064 bytes, got %d", len(sector))
+	}
+	if len(parity) != 172 { // 43 columns × 4 bytes
+		return fmt.Errorf("parity wrong size: need 172 bytes, got %d", len(parity))
+	}
+
+	// Compute parity for each column using LFSR
+	for col := 0; col < 43; col++ {
+		var r0Lsb, r0Msb byte
+		var r1Lsb, r1Msb byte
+
+		// Process 24 rows vertically through this column
+		pos := 2 * col
+		for row := 0; row < 24; row++ {
+			dataLsb := sector[pos]
+			dataMsb := sector[pos+1]
+
+			// Treat header bytes 0-3 as zeros for ECC calculation
+			if zeroHeader && pos < 4 {
+				dataLsb = 0
+				if pos < 3 {
+					dataMsb = 0
+				}
+			}
+
+			// LFSR feedback and shift operations
+			feedbackLsb := dataLsb ^ r1Lsb
+			feedbackMsb := dataMsb ^ r1Msb
+
+			r1Lsb = r0Lsb ^ mul3[feedbackLsb] // g₁ = 3
+			r1Msb = r0Msb ^ mul3[feedbackMsb]
+			r0Lsb = mul2[feedbackLsb] // g₀ = 2
+			r0Msb = mul2[feedbackMsb]
+
+			pos += 86 // Stride to next row (2 bytes × 43 columns)
+		}
+
+		parity[col*2] = r1Lsb
+		parity[col*2+1] = r1Msb
+		parity[86+col*2] = r0Lsb
+		parity[86+col*2+1] = r0Msb
+	}
+	return nil
+}
+
+// QParityLFSR is the CD-ROM Mode 2 Form 1 Q-Parity Generator using a 2-stage LFSR.
+//
+// Instead of computing the parity formula directly, we simulate a shift register
+// that processes sector data sequentially along diagonals. The feedback taps
+// correspond to the same generator polynomial as P-parity.
+//
+// For Q-parity (2 parity bytes), the generator polynomial is:
+//
+//	g(x) = x² + g₁x + g₀
+//
+// over GF(2⁸) with the standard CD-ROM field polynomial 0x11d.
+// Feedback coefficients for the LFSR are g₀ = 2 and g₁ = 3.
+//
+// Q-parity covers 26 diagonals × 43 elements of interleaved sector data.
+// Diagonals wrap around at byte 2236, following an 88-byte stride pattern.
+//
+// Input:  2236 bytes (header + subheader + data + EDC + P-parity, header bytes treated as 0)
+// Output: 104 bytes organized as follows:
+//
+//	Bytes 0-51:   r1 values for all 26 diagonals (LSB/MSB pairs)
+//	Bytes 52-103: r0 values for all 26 diagonals (LSB/MSB pairs)
+//
+// It returns an error if sector is not 2236 bytes long.
+func QParityLFSR(sector []byte) ([]byte, error) {
+	parity := make([]byte, 104)
+	if err := qParity(parity, sector, true); err != nil {
+		return nil, err
+	}
+	return parity, nil
+}
+
+// QParityInto is like QParityLFSR but writes the 104 parity bytes to dst,
+// which may be the Q-parity field of the sector itself, without allocating.
+// It returns an error if dst or sector has the wrong length.
+func QParityInto(dst, sector []byte) error {
+	return qParity(dst, sector, true)
+}
+
+// qParity computes Q-parity into parity, optionally treating the 4 header
+// bytes as zero (Mode 2) or including them (Mode 1).
+func qParity(parity, sector []byte, zeroHeader bool) error {
+	if len(sector) != 2236 {
+		return fmt.Errorf("sector wrong size: need 2236 bytes, got %d", len(sector))
+	}
+	if len(parity) != 104 { // 26 diagonals × 4 bytes
+		return fmt.Errorf("parity wrong size: need 104 bytes, got %d", len(parity))
+	}
+
+	for diag := 0; diag < 26; diag++ {
+		var r0Lsb, r0Msb byte
+		var r1Lsb, r1Msb byte
+
+		pos := 2 * 43 * diag // Start of diagonal
+
+		for step := 0; step < 43; step++ {
+			// Wrap diagonal at sector boundary
+			if pos >= 2236 {
+				pos -= 2236
+			}
+
+			dataLsb := sector[pos]
+			dataMsb := sector[pos+1]
+
+			// Treat header bytes 0-3 as zeros for ECC calculation
+			if zeroHeader && pos < 4 {
+				dataLsb = 0
+				if pos < 3 {
+					dataMsb = 0
+				}
+			}
+
+			// LFSR feedback and shift operations
+			feedbackLsb := dataLsb ^ r1Lsb
+			feedbackMsb := dataMsb ^ r1Msb
+
+			r1Lsb = r0Lsb ^ mul3[feedbackLsb] // g₁ = 3
+			r1Msb = r0Msb ^ mul3[feedbackMsb]
+			r0Lsb = mul2[feedbackLsb] // g₀ = 2
+			r0Msb = mul2[feedbackMsb]
+
+			pos += 88 // Diagonal stride (2 bytes × 44 positions)
+		}
+
+		parity[diag*2] = r1Lsb
+		parity[diag*2+1] = r1Msb
+		parity[52+diag*2] = r0Lsb
+		parity[52+diag*2+1] = r0Msb
+	}
+	return nil
+}
+
+// mustParity panics with err from pParity or qParity called by a sector
+// encoder. The encoders pass slices of a fixed-size sector, so a length
+// error there is a bug in this package, not bad input.
+func mustParity(err error) {
+	if err != nil {
+		panic("pmf: internal error: " + err.Error())
+	}
+}
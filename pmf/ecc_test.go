@@ -0,0 +1,163 @@
+package pmf
+
+import "testing"
+
+// benchSubheader is the subheader of a Mode 2 Form 1 data sector.
+var benchSubheader = []byte{0, 0, 0x08, 0, 0, 0, 0x08, 0}
+
+// benchData returns 2048 bytes of varied user data.
+func benchData() []byte {
+	data := make([]byte, 2048)
+	for i := range data {
+		data[i] = byte(i*31 + i>>8)
+	}
+	return data
+}
+
+// benchSector returns a Mode 2 Form 1 sector of benchData, as the parity
+// generators see it in a conversion.
+func benchSector() [BinSector]byte {
+	header := sectorHeader(1000, 2)
+	return EncodeMode2Form1Sector(header[:], benchSubheader, benchData())
+}
+
+func BenchmarkPParityLFSR(b *testing.B) {
+	sector := benchSector()
+	parity := make([]byte, 172)
+	b.SetBytes(2064)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := PParityInto(parity, sector[12:12+2064]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkQParityLFSR(b *testing.B) {
+	sector := benchSector()
+	parity := make([]byte, 104)
+	b.SetBytes(2236)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := QParityInto(parity, sector[12:12+2236]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeSector(b *testing.B) {
+	data := benchData()
+	b.SetBytes(BinSector)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := EncodeSector(1000, 2, benchSubheader, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// slowMult multiplies a and b in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+// (0x11d) by shift and add, without the lookup tables.
+func slowMult(a, b byte) byte {
+	var p uint16
+	x := uint16(a)
+	for ; b != 0; b >>= 1 {
+		if b&1 != 0 {
+			p ^= x
+		}
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return byte(p)
+}
+
+func TestMulTables(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		a := byte(i)
+		if got, want := mul2[i], slowMult(a, 2); got != want {
+			t.Errorf("mul2[%#02x] = %#02x, want %#02x", i, got, want)
+		}
+		if got, want := mul3[i], slowMult(a, 3); got != want {
+			t.Errorf("mul3[%#02x] = %#02x, want %#02x", i, got, want)
+		}
+		for j := 0; j < 256; j++ {
+			if got, want := gfMult(a, byte(j)), slowMult(a, byte(j)); got != want {
+				t.Fatalf("gfMult(%#02x, %#02x) = %#02x, want %#02x", i, j, got, want)
+			}
+		}
+	}
+}
+
+// slowEDC computes the EDC bit by bit, with the reflected polynomial
+// 0xD8018001 of x^32 + x^31 + x^16 + x^15 + x^4 + x^3 + x + 1.
+func slowEDC(data []byte) [4]byte {
+	var edc uint32
+	for _, b := range data {
+		edc ^= uint32(b)
+		for i := 0; i < 8; i++ {
+			if edc&1 != 0 {
+				edc = edc>>1 ^ 0xD8018001
+			} else {
+				edc >>= 1
+			}
+		}
+	}
+	return [4]byte{byte(edc), byte(edc >> 8), byte(edc >> 16), byte(edc >> 24)}
+}
+
+func TestEDCVectors(t *testing.T) {
+	var vector [2072]byte
+	for i := range vector {
+		vector[i] = byte(i)
+	}
+	if got, want := ComputeEDC(vector[:]), [4]byte{0xE6, 0x62, 0x62, 0xD5}; got != want {
+		t.Errorf("EDC of 00 01 02 ...: % X, want % X", got, want)
+	}
+
+	// A zeroed Mode 1 sector at 00:02:00, covered from the sync on
+	var zero [2328]byte
+	mode1 := EncodeMode1Sector([]byte{0x00, 0x02, 0x00, 0x01}, zero[:PMFMode1Sector])
+	if got, want := mode1[2064:2068], []byte{0xC5, 0x13, 0x68, 0x2B}; string(got) != string(want) {
+		t.Errorf("Mode 1 EDC % X, want % X", got, want)
+	}
+
+	header := []byte{0x00, 0x02, 0x00, 0x02}
+	form1 := EncodeMode2Form1Sector(header, benchSubheader, benchData())
+	form2Subheader := []byte{0, 0, 0x20, 0, 0, 0, 0x20, 0}
+	form2 := EncodeMode2Form2Sector(header, form2Subheader, zero[:PMFForm2Sector-8])
+	for _, tt := range []struct {
+		name      string
+		sector    []byte
+		from, end int // the bytes covered; the EDC follows them
+	}{
+		{"Mode 1", mode1[:], 0, 2064},
+		{"Mode 2 Form 1", form1[:], 16, 2072},
+		{"Mode 2 Form 2", form2[:], 16, 2348},
+	} {
+		if got, want := tt.sector[tt.end:tt.end+4], slowEDC(tt.sector[tt.from:tt.end]); string(got) != string(want[:]) {
+			t.Errorf("%s: EDC % X, want % X over bytes %d-%d", tt.name, got, want, tt.from, tt.end-1)
+		}
+	}
+
+	// Mode 2 leaves the header out of the EDC
+	other := EncodeMode2Form1Sector([]byte{0x00, 0x02, 0x01, 0x02}, benchSubheader, benchData())
+	if string(other[2072:2076]) != string(form1[2072:2076]) {
+		t.Error("Mode 2 Form 1 EDC depends on the header")
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A single wrong table entry must be caught
+	saved := mul3[0x57]
+	mul3[0x57] ^= 0x01
+	defer func() { mul3[0x57] = saved }()
+	if err := SelfTest(); err == nil {
+		t.Error("SelfTest passed with a corrupt mul3 table")
+	}
+}
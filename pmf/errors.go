@@ -0,0 +1,63 @@
+package pmf
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of error returned by ParseFF, WriteBin and the functions built on
+// them. The returned errors are *Error values whose Kind is one of these, so
+// callers can tell them apart with errors.Is (or by comparing Kind).
+var (
+	ErrIO                 = errors.New("I/O error")
+	ErrSyntax             = errors.New("malformed .pmf.ff")
+	ErrTrackCountMismatch = errors.New("track count mismatch")
+	ErrTrackNumber        = errors.New("track numbering mismatch")
+	ErrInvalidMode        = errors.New("invalid track mode")
+	ErrTrackRange         = errors.New("invalid track range")
+	ErrNegativePregap     = errors.New("negative pregap")
+	ErrPregapTooLong      = errors.New("pregap too long")
+	ErrOverlap            = errors.New("overlapping tracks")
+	ErrCapacity           = errors.New("layout exceeds disc capacity")
+	ErrByteOrder          = errors.New("missing audio byte order")
+	ErrStrayByteOrder     = errors.New("audio byte order without audio tracks")
+	ErrSizeMismatch       = errors.New("PMF size mismatch")
+	ErrTruncated          = errors.New("PMF truncated")
+	ErrTrailingData       = errors.New("PMF not fully consumed")
+	ErrMisaligned         = errors.New("PMF data does not match the layout")
+	ErrImageSize          = errors.New("BIN image size mismatch")
+	ErrRoundTrip          = errors.New("BIN sector does not extract to its PMF data")
+	ErrSubchannelImage    = errors.New("BIN image with 2448-byte sectors")
+)
+
+// Error is a categorized error. Its message is the detailed, human-readable
+// description; Kind is the category and Err the underlying error, if any.
+type Error struct {
+	Kind error
+	Msg  string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// Is reports whether target is e's Kind, for errors.Is.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying error, for errors.Is and errors.As.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newError returns an *Error of the given kind with a formatted message.
+func newError(kind error, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+// ioError returns an ErrIO *Error wrapping err, with a formatted message.
+func ioError(err error, format string, args ...interface{}) error {
+	return &Error{Kind: ErrIO, Msg: fmt.Sprintf(format, args...), Err: err}
+}
@@ -0,0 +1,588 @@
+package pmf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ParseFF reads the track table from a .pmf.ff file and validates it against
+// the length of the matching .pmf file. With opts.AllowTrailingPad, a PMF
+// longer than the track table is accepted; BuildBin then checks the excess.
+// A negative pmfLen means the size is unknown (the PMF is read from a pipe)
+// and skips the size check. Along with the tracks it returns the settings
+// that apply to the whole disc, for Options.Disc.
+func ParseFF(ffPath string, pmfLen int, opts Options) (tracks []Track, disc Disc, err error) {
+	f, err := os.Open(ffPath)
+	if err != nil {
+		return nil, Disc{}, ioError(err, "failed to open %s: %v", ffPath, err)
+	}
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		closeErr := f.Close()
+		if err == nil && closeErr != nil {
+			err = ioError(closeErr, "Close failed: %v", closeErr)
+		}
+	}()
+
+	return ParseFFReader(f, pmfLen, opts)
+}
+
+// ParseFFReader is like ParseFF but reads the .pmf.ff contents from r.
+func ParseFFReader(r io.Reader, pmfLen int, opts Options) ([]Track, Disc, error) {
+	var disc Disc
+	tracks, err := parseFF(r, pmfLen, opts, &disc)
+	if err != nil {
+		return nil, Disc{}, err
+	}
+	return tracks, disc, nil
+}
+
+// parseFF does the work of ParseFFReader, filling in disc as the directives
+// are read.
+func parseFF(r io.Reader, pmfLen int, opts Options, disc *Disc) ([]Track, error) {
+	var tracks []Track
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanLines)
+	var numExpected int
+	inSection := false
+	ended := false // %END_OF_ADDED_TRACK_DATA was seen
+	lineNum := 0
+	pregaps := make(map[int]int)     // explicit %PREGAP lengths by track number
+	gapless := make(map[int]bool)    // tracks marked %GAPLESS
+	sessionGaps := make(map[int]int) // inter-session gaps by the track after them
+	startCount := false              // track lines give a sector count instead of the end
+
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if lineNum == 1 {
+			// Windows editors often save UTF-8 with a byte order mark
+			line = strings.TrimPrefix(line, "\uFEFF")
+		}
+
+		line = strings.TrimSpace(stripComment(line))
+
+		// Skip empty lines
+		if line == "" {
+			continue
+		}
+		// Detect audio byte order
+		if strings.HasPrefix(line, "AUDIO_BYTE_ORDER:") {
+			switch order := strings.TrimSpace(strings.TrimPrefix(line, "AUDIO_BYTE_ORDER:")); order {
+			case "AUDIO_MSB":
+				disc.AudioMSB = true
+			case "AUDIO_LSB":
+				disc.AudioMSB = false
+			default:
+				return nil, newError(ErrSyntax, "line %d: unknown AUDIO_BYTE_ORDER %q: expected AUDIO_LSB or AUDIO_MSB", lineNum, order)
+			}
+			disc.ByteOrderDeclared = true
+			continue
+		}
+		// Detect number of tracks
+		if strings.HasPrefix(line, "%NUMBER_OF_ADDED_TRACKS") {
+			if _, err := fmt.Sscanf(line, "%%NUMBER_OF_ADDED_TRACKS %d", &numExpected); err != nil {
+				return nil, newError(ErrSyntax, "line %d: malformed %%NUMBER_OF_ADDED_TRACKS directive %q", lineNum, line)
+			}
+			if numExpected < 1 || numExpected > MaxTracks {
+				return nil, newError(ErrTrackCountMismatch, "line %d: implausible track count %d: a disc holds 1 to %d tracks", lineNum, numExpected, MaxTracks)
+			}
+			continue
+		}
+		// Explicit pregap: %PREGAP <track> <sectors>
+		if strings.HasPrefix(line, "%PREGAP") {
+			var num, sectors int
+			if _, err := fmt.Sscanf(line, "%%PREGAP %d %d", &num, &sectors); err != nil {
+				return nil, newError(ErrSyntax, "line %d: malformed %%PREGAP directive %q", lineNum, line)
+			}
+			if sectors < 0 {
+				return nil, newError(ErrNegativePregap, "line %d: negative pregap for track %d", lineNum, num)
+			}
+			if sectors >= MaxDiscSectors {
+				return nil, newError(ErrPregapTooLong, "line %d: %d-sector pregap for track %d is longer than a disc", lineNum, sectors, num)
+			}
+			if _, dup := pregaps[num]; dup {
+				return nil, newError(ErrSyntax, "line %d: duplicate %%PREGAP for track %d", lineNum, num)
+			}
+			pregaps[num] = sectors
+			continue
+		}
+		// Gapless track: %GAPLESS <track>
+		if strings.HasPrefix(line, "%GAPLESS") {
+			var num int
+			if _, err := fmt.Sscanf(line, "%%GAPLESS %d", &num); err != nil {
+				return nil, newError(ErrSyntax, "line %d: malformed %%GAPLESS directive %q", lineNum, line)
+			}
+			if gapless[num] {
+				return nil, newError(ErrSyntax, "line %d: duplicate %%GAPLESS for track %d", lineNum, num)
+			}
+			gapless[num] = true
+			continue
+		}
+		// Track line grammar: %TRACK_FORMAT START_END or START_COUNT
+		if strings.HasPrefix(line, "%TRACK_FORMAT") {
+			if len(tracks) > 0 {
+				return nil, newError(ErrSyntax, "line %d: %%TRACK_FORMAT after the first track line; one file cannot mix formats", lineNum)
+			}
+			switch format := strings.TrimSpace(strings.TrimPrefix(line, "%TRACK_FORMAT")); format {
+			case "START_END":
+				startCount = false
+			case "START_COUNT":
+				startCount = true
+			default:
+				return nil, newError(ErrSyntax, "line %d: unknown %%TRACK_FORMAT %q: expected START_END or START_COUNT", lineNum, format)
+			}
+			continue
+		}
+		// Media catalog number: CATALOG <13 digits>
+		if strings.HasPrefix(line, "CATALOG") {
+			code := strings.TrimSpace(strings.TrimPrefix(line, "CATALOG"))
+			if !validCatalog(code) {
+				return nil, newError(ErrSyntax, "line %d: invalid CATALOG %q: expected 13 digits", lineNum, code)
+			}
+			disc.Catalog = code
+			continue
+		}
+		if strings.HasPrefix(line, "%START_OF_ADDED_TRACK_DATA") {
+			if ended {
+				return nil, newError(ErrSyntax, "line %d: %%START_OF_ADDED_TRACK_DATA after %%END_OF_ADDED_TRACK_DATA", lineNum)
+			}
+			inSection = true
+			continue
+		}
+		// The track data may be closed, leaving the rest of the file to
+		// directives and footer lines
+		if strings.HasPrefix(line, "%END_OF_ADDED_TRACK_DATA") {
+			if !inSection {
+				return nil, newError(ErrSyntax, "line %d: %%END_OF_ADDED_TRACK_DATA without %%START_OF_ADDED_TRACK_DATA", lineNum)
+			}
+			inSection, ended = false, true
+			continue
+		}
+		// TITLE/PERFORMER before the first track line describe the disc,
+		// afterwards the track line before them
+		if key := strings.Fields(line)[0]; key == "TITLE" || key == "PERFORMER" {
+			value, err := parseCDText(strings.TrimSpace(strings.TrimPrefix(line, key)))
+			if err != nil {
+				return nil, newError(ErrSyntax, "line %d: invalid %s: %v", lineNum, key, err)
+			}
+			switch {
+			case len(tracks) == 0 && key == "TITLE":
+				disc.Title = value
+			case len(tracks) == 0:
+				disc.Performer = value
+			case key == "TITLE":
+				tracks[len(tracks)-1].Title = value
+			default:
+				tracks[len(tracks)-1].Performer = value
+			}
+			continue
+		}
+		if !inSection {
+			if ended && (strings.HasPrefix(line, "%SESSION") || isTrackLine(line)) {
+				return nil, newError(ErrSyntax, "line %d: track data after %%END_OF_ADDED_TRACK_DATA", lineNum)
+			}
+			continue
+		}
+
+		// %SESSION [gap] starts a new session with the next track line
+		if strings.HasPrefix(line, "%SESSION") {
+			gap := DefaultSessionGap
+			if arg := strings.TrimSpace(strings.TrimPrefix(line, "%SESSION")); arg != "" {
+				n, err := strconv.Atoi(arg)
+				if err != nil || n < 0 || n >= MaxDiscSectors {
+					return nil, newError(ErrSyntax, "line %d: invalid session gap %q", lineNum, arg)
+				}
+				gap = n
+			}
+			if len(tracks) == 0 {
+				return nil, newError(ErrSyntax, "line %d: %%SESSION before the first track", lineNum)
+			}
+			if _, dup := sessionGaps[len(tracks)+1]; dup {
+				return nil, newError(ErrSyntax, "line %d: empty session", lineNum)
+			}
+			sessionGaps[len(tracks)+1] = gap
+			continue
+		}
+
+		// ISRC <code> applies to the track line before it
+		if strings.HasPrefix(line, "ISRC") {
+			code := strings.TrimSpace(strings.TrimPrefix(line, "ISRC"))
+			if len(tracks) == 0 {
+				return nil, newError(ErrSyntax, "line %d: ISRC before the first track", lineNum)
+			}
+			if !validISRC(code) {
+				return nil, newError(ErrSyntax, "line %d: invalid ISRC %q: expected 5 letters or digits and 7 digits", lineNum, code)
+			}
+			tracks[len(tracks)-1].ISRC = code
+			continue
+		}
+
+		t, err := parseTrackLine(line)
+		if err != nil {
+			return nil, newError(ErrSyntax, "line %d: %v", lineNum, err)
+		}
+		if startCount {
+			// The last field is the number of sectors
+			if t.End < 1 || t.End > MaxDiscSectors {
+				return nil, newError(ErrTrackRange, "line %d: track %d has a sector count of %d", lineNum, t.Num, t.End)
+			}
+			t.End = t.Start + t.End - 1
+		}
+		tracks = append(tracks, t)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, ioError(err, "error reading pmf.ff: %v", err)
+	}
+
+	if len(tracks) == 0 {
+		return nil, newError(ErrTrackCountMismatch, "no tracks found in pmf.ff")
+	}
+
+	if numExpected > 0 && len(tracks) != numExpected {
+		return nil, newError(ErrTrackCountMismatch, "track count mismatch: expected %d, found %d",
+			numExpected, len(tracks))
+	}
+
+	for num := range gapless {
+		if num < 1 || num > len(tracks) {
+			return nil, newError(ErrSyntax, "%%GAPLESS for unknown track %d", num)
+		}
+		tracks[num-1].Gapless = true
+	}
+
+	return layoutTracks(tracks, pregaps, sessionGaps, pmfLen, *disc, opts)
+}
+
+// layoutTracks completes and validates tracks as read from a track table:
+// numbered from 1, each with its mode and its first and last sector. It
+// infers the pregaps from the gaps between the tracks, applies the explicit
+// pregaps and session gaps (keyed by track number), and checks the result
+// against the disc capacity and, unless pmfLen is negative, the PMF size.
+// disc is what the track table declared for the whole disc.
+func layoutTracks(tracks []Track, pregaps, sessionGaps map[int]int, pmfLen int, disc Disc, opts Options) ([]Track, error) {
+	if len(tracks) > MaxTracks {
+		return nil, newError(ErrTrackCountMismatch, "implausible track count %d: a disc holds 1 to %d tracks", len(tracks), MaxTracks)
+	}
+	for num := range sessionGaps {
+		if num > len(tracks) {
+			return nil, newError(ErrSyntax, "%%SESSION after the last track")
+		}
+	}
+	for num := range pregaps {
+		if num < 1 || num > len(tracks) {
+			return nil, newError(ErrSyntax, "%%PREGAP for unknown track %d", num)
+		}
+	}
+
+	// Validate each track
+	shift := 0 // sectors added or removed by explicit pregaps so far
+	session := 1
+	for i := range tracks {
+		t := &tracks[i]
+
+		// Mode check
+		if _, ok := lookupMode(t.Mode); !ok {
+			return nil, newError(ErrInvalidMode, "track %d: unsupported mode %d; supported modes are %s", t.Num, t.Mode, supportedModes())
+		}
+
+		// Sequential numbering check
+		if t.Num != i+1 {
+			return nil, newError(ErrTrackNumber, "track numbering mismatch: got %d, expected %d", t.Num, i+1)
+		}
+
+		// Logical start/end
+		if t.Start < 0 {
+			return nil, newError(ErrTrackRange, "track %d starts before 00:00:00 (sector %d)", t.Num, t.Start)
+		}
+		if t.Start > t.End {
+			return nil, newError(ErrTrackRange, "track %d start sector (%d) is after end sector (%d)", t.Num, t.Start, t.End)
+		}
+		// Bounding every value keeps the shifts below from overflowing
+		if t.End >= MaxDiscSectors {
+			return nil, newError(ErrTrackRange, "track %d end sector (%d) is past the last address of a disc (%d)", t.Num, t.End, MaxDiscSectors-1)
+		}
+
+		// Follow any earlier explicit pregap
+		t.Start += shift
+		t.End += shift
+
+		// Pregap calculation; the image always begins at sector 0, so
+		// anything before track 1 is its pregap (a hidden track area)
+		if i == 0 {
+			t.Pregap = t.Start
+		} else {
+			prev := &tracks[i-1]
+			t.Pregap = t.Start - prev.End - 1
+			if t.Pregap < 0 {
+				return nil, newError(ErrNegativePregap, "track %d has negative pregap (%d sectors)", t.Num, t.Pregap)
+			}
+			if t.Start <= prev.End {
+				return nil, newError(ErrOverlap, "track %d overlaps previous track (start=%d, prev end=%d)", t.Num, t.Start, prev.End)
+			}
+		}
+
+		// A new session begins with the gap between the sessions, taken
+		// from the space before the track; if there is not enough, the
+		// track and every later one move back to make room
+		if gap, ok := sessionGaps[t.Num]; ok {
+			session++
+			t.SessionGap = gap
+			if t.Pregap >= gap {
+				t.Pregap -= gap
+			} else {
+				delta := gap - t.Pregap
+				t.Start += delta
+				t.End += delta
+				shift += delta
+				t.Pregap = 0
+			}
+		}
+		t.Session = session
+
+		// An explicit pregap replaces the inferred one, moving this track
+		// and every later one by the difference
+		if pregap, ok := pregaps[t.Num]; ok {
+			delta := pregap - t.Pregap
+			t.Start += delta
+			t.End += delta
+			shift += delta
+			t.Pregap = pregap
+		} else if err := checkPregap(t, opts); err != nil {
+			return nil, err
+		}
+		if t.Gapless && t.Pregap > 0 {
+			return nil, newError(ErrTrackRange, "track %d is marked %%GAPLESS but has a %d-sector pregap", t.Num, t.Pregap)
+		}
+
+		// Audio ordering warning
+		if i > 0 && tracks[i-1].Mode == 4 && t.Mode != 4 {
+			Warn.Printf("data track follows audio track (unusual ordering)")
+		}
+	}
+
+	if err := checkCapacity(tracks, opts); err != nil {
+		return nil, err
+	}
+
+	if opts.RequireByteOrder && !disc.ByteOrderDeclared && hasAudio(tracks) {
+		return nil, newError(ErrByteOrder, "audio tracks present but no AUDIO_BYTE_ORDER directive")
+	}
+	if disc.ByteOrderDeclared && !hasAudio(tracks) {
+		// Harmless in itself, but it may mean a track's mode is wrong
+		if opts.Strict {
+			return nil, newError(ErrStrayByteOrder, "AUDIO_BYTE_ORDER directive but no audio (mode 4) tracks")
+		}
+		Warn.Printf("AUDIO_BYTE_ORDER directive but no audio (mode 4) tracks; check the track modes")
+	}
+
+	// Verify tracks align with PMF size
+	expectedSize := ExpectedSize(tracks)
+	mode2Sectors := 0
+	for _, t := range tracks {
+		if t.Mode == 2 {
+			mode2Sectors += t.End - t.Start + 1
+		}
+	}
+	if pmfLen >= 0 && expectedSize != pmfLen {
+		// Any Form 2 sectors make the PMF larger by a whole number of
+		// (2332 - 2056)-byte steps, up to one per Mode 2 sector
+		extra := pmfLen - expectedSize
+		step := PMFForm2Sector - PMFSector
+		padded := opts.AllowTrailingPad && extra > 0
+		if opts.PadMissing && extra < 0 {
+			Warn.Printf("PMF is %d bytes shorter than the track table; the missing sectors will be zero-filled", -extra)
+			padded = true
+		}
+		if opts.PadAudio && tracks[len(tracks)-1].Mode == 4 {
+			// The final audio sector may be short by up to a sector
+			form2 := extra
+			if form2 < 0 {
+				form2 = 0
+			}
+			form2 = (form2 + step - 1) / step * step
+			padded = padded || (form2-extra < BinSector && form2/step <= mode2Sectors)
+		}
+		if !padded && (extra < 0 || extra%step != 0 || extra/step > mode2Sectors) {
+			return nil, newError(ErrSizeMismatch, "PMF length mismatch: expected %d bytes, got %d bytes", expectedSize, pmfLen)
+		}
+	}
+
+	return tracks, nil
+}
+
+// checkCapacity rejects a layout whose last sector lies beyond the capacity
+// of the disc, which MSF addresses past 99:59:74 could not even express.
+func checkCapacity(tracks []Track, opts Options) error {
+	limit := opts.MaxSectors
+	if limit <= 0 {
+		limit = Disc80Sectors
+	}
+	if limit > MaxDiscSectors {
+		limit = MaxDiscSectors
+	}
+	last := tracks[len(tracks)-1]
+	if end := last.End + opts.leadIn(); end >= limit {
+		return newError(ErrCapacity, "track %d ends at %s, past the last sector of the disc at %s", last.Num, LBAToMSFFormatted(end), LBAToMSFFormatted(limit-1))
+	}
+	return nil
+}
+
+// checkPregap reports an inferred pregap that is long enough to suggest a
+// mistyped start sector rather than a real gap: a warning above the warning
+// threshold and an error above MaxPregap.
+func checkPregap(t *Track, opts Options) error {
+	if opts.MaxPregap > 0 && t.Pregap > opts.MaxPregap {
+		return newError(ErrPregapTooLong, "track %d has a %d-sector pregap (%s), more than the %d allowed", t.Num, t.Pregap, LBAToMSFFormatted(t.Pregap), opts.MaxPregap)
+	}
+	warn := opts.PregapWarn
+	if warn == 0 {
+		warn = DefaultPregapWarn
+	}
+	if warn > 0 && t.Pregap > warn {
+		Warn.Printf("track %d has a %d-sector pregap (%s); check its start sector", t.Num, t.Pregap, LBAToMSFFormatted(t.Pregap))
+	}
+	return nil
+}
+
+// parseTrackLine parses a "num mode start end" track line. Anything other
+// than exactly four integers is rejected.
+func parseTrackLine(line string) (Track, error) {
+	var t Track
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return t, fmt.Errorf("malformed track line %q: expected 4 fields, got %d", line, len(fields))
+	}
+	values := []*int{&t.Num, &t.Mode, &t.Start, &t.End}
+	for i, f := range fields {
+		v, err := strconv.Atoi(f)
+		if err != nil {
+			return t, fmt.Errorf("malformed track line %q: %q is not a number", line, f)
+		}
+		*values[i] = v
+	}
+	return t, nil
+}
+
+// isTrackLine reports whether line is a well-formed track line.
+func isTrackLine(line string) bool {
+	_, err := parseTrackLine(line)
+	return err == nil
+}
+
+// scanLines is a bufio.SplitFunc like bufio.ScanLines that also accepts a
+// lone carriage return as a line ending, so files with Unix, Windows and old
+// Mac line endings, or a mixture of them, all split into the same lines.
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for i, c := range data {
+		switch c {
+		case '\n':
+			return i + 1, data[:i], nil
+		case '\r':
+			if i+1 < len(data) {
+				if data[i+1] == '\n' {
+					return i + 2, data[:i], nil
+				}
+				return i + 1, data[:i], nil
+			}
+			if atEOF {
+				return i + 1, data[:i], nil
+			}
+			// Need the next byte to tell \r from \r\n
+			return 0, nil, nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// stripComment removes a '#' or ';' comment, and everything after it, from
+// line. Comment characters inside double quotes are kept.
+func stripComment(line string) string {
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case (c == '#' || c == ';') && !quoted:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseCDText returns the value of a TITLE or PERFORMER directive, which may
+// be given in double quotes. Quotes cannot appear inside the value, since the
+// cue sheet has no way to escape them.
+func parseCDText(s string) (string, error) {
+	if strings.HasPrefix(s, "\"") {
+		if len(s) < 2 || !strings.HasSuffix(s, "\"") {
+			return "", fmt.Errorf("unterminated quote in %s", s)
+		}
+		s = s[1 : len(s)-1]
+	}
+	if strings.Contains(s, "\"") {
+		return "", fmt.Errorf("%s contains a double quote", s)
+	}
+	if s == "" {
+		return "", fmt.Errorf("empty value")
+	}
+	return s, nil
+}
+
+// validCatalog reports whether code is a 13-digit UPC/EAN catalog number.
+func validCatalog(code string) bool {
+	if len(code) != 13 {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// validISRC reports whether code is a 12-character ISRC: a 2-character
+// country code and 3-character owner code (uppercase letters or digits),
+// followed by a 2-digit year and 5-digit serial number.
+func validISRC(code string) bool {
+	if len(code) != 12 {
+		return false
+	}
+	for i, c := range code {
+		digit := c >= '0' && c <= '9'
+		if i < 5 && !digit && (c < 'A' || c > 'Z') {
+			return false
+		}
+		if i >= 5 && !digit {
+			return false
+		}
+	}
+	return true
+}
+
+// ExpectedSize returns the PMF size in bytes implied by the track table,
+// assuming every Mode 2 sector is Form 1. Pregaps are never stored in the PMF,
+// so the size does not depend on whether they are physical or logical.
+func ExpectedSize(tracks []Track) int {
+	size := 0
+	for _, t := range tracks {
+		sectorCount := t.End - t.Start + 1 // if End is inclusive
+		size += sectorCount * pmfSectorSize(t.Mode)
+	}
+	return size
+}
+
+// pmfSectorSize returns the number of PMF bytes per sector for a track mode,
+// counting Mode 2 sectors as Form 1.
+func pmfSectorSize(mode int) int {
+	return modeOf(mode).pmfSector
+}
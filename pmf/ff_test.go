@@ -0,0 +1,350 @@
+package pmf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// parseFFString parses a .pmf.ff held in a string, skipping the size check.
+func parseFFString(ff string) ([]Track, Disc, error) {
+	return ParseFFReader(strings.NewReader(ff), -1, Options{})
+}
+
+func TestParseFFReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		ff     string
+		tracks []Track // the Num, Mode, Start, End and Pregap expected
+		kind   error
+		err    string
+	}{
+		{
+			name: "data and audio",
+			ff: "AUDIO_BYTE_ORDER: AUDIO_MSB\n" +
+				"%NUMBER_OF_ADDED_TRACKS 2\n" +
+				"%START_OF_ADDED_TRACK_DATA\n" +
+				"1 2 0 9\n" +
+				"2 4 160 164\n",
+			tracks: []Track{
+				{Num: 1, Mode: 2, Start: 0, End: 9},
+				{Num: 2, Mode: 4, Start: 160, End: 164, Pregap: 150},
+			},
+		},
+		{
+			name: "unknown lines before the track data are skipped",
+			ff: "PREMASTER FILE v1.0\n" +
+				"%NUMBER_OF_ADDED_TRACKS 1\n" +
+				"GENERATED BY SOME TOOL\n" +
+				"%START_OF_ADDED_TRACK_DATA\n" +
+				"1 1 0 3\n",
+			tracks: []Track{
+				{Num: 1, Mode: 1, Start: 0, End: 3},
+			},
+		},
+		{
+			name: "track count mismatch",
+			ff: "%NUMBER_OF_ADDED_TRACKS 3\n" +
+				"%START_OF_ADDED_TRACK_DATA\n" +
+				"1 2 0 9\n" +
+				"2 4 160 164\n",
+			kind: ErrTrackCountMismatch,
+			err:  "track count mismatch: expected 3, found 2",
+		},
+		{
+			name: "no tracks",
+			ff:   "%NUMBER_OF_ADDED_TRACKS 1\n%START_OF_ADDED_TRACK_DATA\n",
+			kind: ErrTrackCountMismatch,
+			err:  "no tracks found in pmf.ff",
+		},
+		{
+			name: "negative pregap",
+			ff: "%START_OF_ADDED_TRACK_DATA\n" +
+				"1 2 0 99\n" +
+				"2 2 90 199\n",
+			kind: ErrNegativePregap,
+			err:  "track 2 has negative pregap (-10 sectors)",
+		},
+		{
+			name: "negative explicit pregap",
+			ff: "%PREGAP 2 -1\n" +
+				"%START_OF_ADDED_TRACK_DATA\n" +
+				"1 2 0 99\n" +
+				"2 2 100 199\n",
+			kind: ErrNegativePregap,
+			err:  "line 1: negative pregap for track 2",
+		},
+		{
+			name: "numbering",
+			ff:   "%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n3 2 10 19\n",
+			kind: ErrTrackNumber,
+			err:  "track numbering mismatch: got 3, expected 2",
+		},
+		{
+			name: "unsupported mode",
+			ff:   "%START_OF_ADDED_TRACK_DATA\n1 7 0 9\n",
+			kind: ErrInvalidMode,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracks, _, err := parseFFString(tt.ff)
+			if tt.kind != nil {
+				if !errors.Is(err, tt.kind) {
+					t.Fatalf("error %v, want kind %v", err, tt.kind)
+				}
+				if tt.err != "" && err.Error() != tt.err {
+					t.Fatalf("error %q, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTracks(t, tracks, tt.tracks)
+		})
+	}
+}
+
+func TestParseFFSize(t *testing.T) {
+	ff := "%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n2 4 160 164\n"
+	size := 10*PMFSector + 5*BinSector
+	if _, _, err := ParseFFReader(strings.NewReader(ff), size, Options{}); err != nil {
+		t.Fatalf("size %d: %v", size, err)
+	}
+	_, _, err := ParseFFReader(strings.NewReader(ff), size-1, Options{})
+	if !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("size %d: error %v, want %v", size-1, err, ErrSizeMismatch)
+	}
+}
+
+// checkTracks compares the numbering, modes, sectors and pregaps of tracks
+// with want.
+func checkTracks(t *testing.T, tracks, want []Track) {
+	t.Helper()
+	if len(tracks) != len(want) {
+		t.Fatalf("got %d tracks, want %d", len(tracks), len(want))
+	}
+	for i, w := range want {
+		g := tracks[i]
+		if g.Num != w.Num || g.Mode != w.Mode || g.Start != w.Start || g.End != w.End || g.Pregap != w.Pregap {
+			t.Errorf("track %d: got %d %d %d-%d pregap %d, want %d %d %d-%d pregap %d", i+1,
+				g.Num, g.Mode, g.Start, g.End, g.Pregap, w.Num, w.Mode, w.Start, w.End, w.Pregap)
+		}
+	}
+}
+
+func TestParseFFComments(t *testing.T) {
+	ff := "# exported by the mastering tool\n" +
+		"; checked by hand\n" +
+		"%NUMBER_OF_ADDED_TRACKS 2 # two tracks\n" +
+		"%START_OF_ADDED_TRACK_DATA\n" +
+		"1 2 0 9 ; the data track\n" +
+		"# 2 2 10 19\n" +
+		"2 4 160 164\n"
+	tracks, _, err := parseFFString(ff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTracks(t, tracks, []Track{
+		{Num: 1, Mode: 2, Start: 0, End: 9},
+		{Num: 2, Mode: 4, Start: 160, End: 164, Pregap: 150},
+	})
+}
+
+func TestParseFFCorruptTrackLine(t *testing.T) {
+	for _, line := range []string{"2 4 16O 164", "2 4 160", "2 4 160 164 0"} {
+		ff := "%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n" + line + "\n"
+		_, _, err := parseFFString(ff)
+		if !errors.Is(err, ErrSyntax) {
+			t.Errorf("%q: error %v, want %v", line, err, ErrSyntax)
+		} else if !strings.HasPrefix(err.Error(), "line 3: malformed track line") {
+			t.Errorf("%q: error %q does not name the line", line, err)
+		}
+	}
+}
+
+func TestParseFFLineEndings(t *testing.T) {
+	unix := "AUDIO_BYTE_ORDER: AUDIO_MSB\n" +
+		"%NUMBER_OF_ADDED_TRACKS 2\n" +
+		"%START_OF_ADDED_TRACK_DATA\n" +
+		"1 2 0 9\n" +
+		"2 4 160 164\n"
+	want, wantDisc, err := parseFFString(unix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, ff := range map[string]string{
+		"BOM and CRLF": "\uFEFF" + strings.Replace(unix, "\n", "\r\n", -1),
+		"CR":           strings.Replace(unix, "\n", "\r", -1),
+		"mixed":        "\uFEFF  AUDIO_BYTE_ORDER: AUDIO_MSB \r\n%NUMBER_OF_ADDED_TRACKS 2\r\t%START_OF_ADDED_TRACK_DATA\n1 2 0 9\r\n2 4 160 164",
+	} {
+		tracks, disc, err := parseFFString(ff)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if disc != wantDisc {
+			t.Errorf("%s: disc %+v, want %+v", name, disc, wantDisc)
+		}
+		checkTracks(t, tracks, want)
+	}
+}
+
+func TestParseFFTrackFormat(t *testing.T) {
+	startEnd, _, err := parseFFString("%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n2 1 20 49\n3 4 200 299\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	startCount, _, err := parseFFString("%TRACK_FORMAT START_COUNT\n%START_OF_ADDED_TRACK_DATA\n1 2 0 10\n2 1 20 30\n3 4 200 100\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTracks(t, startCount, startEnd)
+
+	for name, ff := range map[string]string{
+		"mixed":      "%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n%TRACK_FORMAT START_COUNT\n2 1 20 30\n",
+		"zero count": "%TRACK_FORMAT START_COUNT\n%START_OF_ADDED_TRACK_DATA\n1 2 0 0\n",
+		"unknown":    "%TRACK_FORMAT START_LENGTH\n%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n",
+	} {
+		if _, _, err := parseFFString(ff); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+// FuzzParseFF checks that no .pmf.ff makes the parser panic, only fail.
+func FuzzParseFF(f *testing.F) {
+	for _, seed := range []string{
+		"AUDIO_BYTE_ORDER: AUDIO_MSB\n%NUMBER_OF_ADDED_TRACKS 2\n%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n2 4 160 164\n",
+		"%TRACK_FORMAT START_COUNT\n%START_OF_ADDED_TRACK_DATA\n1 1 0 4\n%END_OF_ADDED_TRACK_DATA\nCHECKSUM 0\n",
+		"%PREGAP 2 150\n%GAPLESS 3\n%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n2 4 10 19\n3 4 20 29\n",
+		"CATALOG 0123456789012\nTITLE \"Disc\"\n%START_OF_ADDED_TRACK_DATA\n1 2 0 9\nISRC USABC1234567\n%SESSION 11400\n2 2 20000 20099\n",
+		"%NUMBER_OF_ADDED_TRACKS 999999999\n",
+		"%START_OF_ADDED_TRACK_DATA\n1 2 0 9223372036854775807\n2 2 -9223372036854775808 0\n",
+	} {
+		f.Add(seed)
+	}
+	// Many inputs draw warnings, which would flood the fuzzing workers
+	w := Warn.Writer()
+	Warn.SetOutput(ioutil.Discard)
+	defer Warn.SetOutput(w)
+	f.Fuzz(func(t *testing.T, ff string) {
+		tracks, _, err := ParseFFReader(strings.NewReader(ff), 10*PMFSector, Options{})
+		if err == nil && len(tracks) == 0 {
+			t.Error("no error and no tracks")
+		}
+	})
+}
+
+func TestParseFFByteOrder(t *testing.T) {
+	tracks := "%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n2 4 160 164\n"
+	for order, msb := range map[string]bool{"AUDIO_MSB": true, "AUDIO_LSB": false} {
+		_, disc, err := parseFFString("AUDIO_BYTE_ORDER: " + order + "\n" + tracks)
+		if err != nil {
+			t.Errorf("%s: %v", order, err)
+			continue
+		}
+		if disc.AudioMSB != msb || !disc.ByteOrderDeclared {
+			t.Errorf("%s: AudioMSB %v, declared %v", order, disc.AudioMSB, disc.ByteOrderDeclared)
+		}
+	}
+
+	_, _, err := parseFFString("AUDIO_BYTE_ORDER: AUDIO_LBS\n" + tracks)
+	if !errors.Is(err, ErrSyntax) {
+		t.Fatalf("error %v, want %v", err, ErrSyntax)
+	}
+	if want := `line 1: unknown AUDIO_BYTE_ORDER "AUDIO_LBS": expected AUDIO_LSB or AUDIO_MSB`; err.Error() != want {
+		t.Errorf("error %q, want %q", err, want)
+	}
+}
+
+func TestParseFFTrackCount(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("%NUMBER_OF_ADDED_TRACKS 99\n%START_OF_ADDED_TRACK_DATA\n")
+	for i := 0; i < 99; i++ {
+		fmt.Fprintf(&b, "%d 2 %d %d\n", i+1, i*10, i*10+9)
+	}
+	if tracks, _, err := parseFFString(b.String()); err != nil {
+		t.Errorf("99 tracks: %v", err)
+	} else if len(tracks) != 99 {
+		t.Errorf("99 tracks: got %d", len(tracks))
+	}
+
+	for _, n := range []int{0, 100, -1} {
+		ff := fmt.Sprintf("%%NUMBER_OF_ADDED_TRACKS %d\n%%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n", n)
+		_, _, err := parseFFString(ff)
+		if !errors.Is(err, ErrTrackCountMismatch) {
+			t.Errorf("%d tracks: error %v, want %v", n, err, ErrTrackCountMismatch)
+		} else if want := fmt.Sprintf("line 1: implausible track count %d: a disc holds 1 to 99 tracks", n); err.Error() != want {
+			t.Errorf("%d tracks: error %q, want %q", n, err, want)
+		}
+	}
+}
+
+func TestParseFFFooter(t *testing.T) {
+	tracks, disc, err := ParseFF(filepath.Join("testdata", "footer.pmf.ff"), 10*PMFSector+5*BinSector, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTracks(t, tracks, []Track{
+		{Num: 1, Mode: 2, Start: 0, End: 9},
+		{Num: 2, Mode: 4, Start: 160, End: 164, Pregap: 150},
+	})
+	if !disc.AudioMSB || disc.Catalog != "0123456789012" {
+		t.Errorf("directives after the track data not read: AudioMSB %v, catalog %q", disc.AudioMSB, disc.Catalog)
+	}
+
+	for name, ff := range map[string]string{
+		"track line after the end": "%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n%END_OF_ADDED_TRACK_DATA\n2 2 10 19\n",
+		"session after the end":    "%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n%END_OF_ADDED_TRACK_DATA\n%SESSION\n",
+		"second start":             "%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n%END_OF_ADDED_TRACK_DATA\n%START_OF_ADDED_TRACK_DATA\n",
+		"end without start":        "%END_OF_ADDED_TRACK_DATA\n%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n",
+	} {
+		if _, _, err := parseFFString(ff); !errors.Is(err, ErrSyntax) {
+			t.Errorf("%s: error %v, want %v", name, err, ErrSyntax)
+		}
+	}
+}
+
+func TestParseFFCDText(t *testing.T) {
+	tracks, disc, err := parseFFString("TITLE \"Disc\"\nPERFORMER \"Band\"\nTITLEX \"Not a title\"\nPERFORMERS \"Nobody\"\n" +
+		"%START_OF_ADDED_TRACK_DATA\n1 2 0 9\nTITLE \"One\"\n2 4 160 164\nPERFORMER \"Guest\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disc.Title != "Disc" || disc.Performer != "Band" {
+		t.Errorf("disc title %q, performer %q, want \"Disc\", \"Band\"", disc.Title, disc.Performer)
+	}
+	if tracks[0].Title != "One" || tracks[0].Performer != "" {
+		t.Errorf("track 1 title %q, performer %q, want \"One\", \"\"", tracks[0].Title, tracks[0].Performer)
+	}
+	if tracks[1].Title != "" || tracks[1].Performer != "Guest" {
+		t.Errorf("track 2 title %q, performer %q, want \"\", \"Guest\"", tracks[1].Title, tracks[1].Performer)
+	}
+}
+
+func TestDiscTOC(t *testing.T) {
+	tracks, _, err := parseFFString("%START_OF_ADDED_TRACK_DATA\n1 2 0 9\n2 4 160 9999\n3 4 10000 19999\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		leadIn int
+		msf    string
+	}{
+		{0, "04:28:50"},
+		{NoLeadIn, "04:26:50"},
+		{300, "04:30:50"},
+	} {
+		toc := DiscTOC(tracks, Options{LeadIn: tt.leadIn})
+		want := TOC{FirstTrack: 1, LastTrack: 3, LeadOut: 20000, LeadOutMSF: tt.msf}
+		if toc != want {
+			t.Errorf("lead-in %d: TOC %+v, want %+v", tt.leadIn, toc, want)
+		}
+	}
+}
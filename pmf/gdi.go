@@ -0,0 +1,68 @@
+package pmf
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WriteGDI writes a .gdi track list, the layout description used for
+// Dreamcast GD-ROM images, for tracks split into one BIN file per track by
+// BuildSplitBin. After the track count, each line gives the track number,
+// the address of the first sector in its file, the type (4 for data, 0 for
+// audio), the sector size, the file name and a byte offset of 0. Each file
+// holds the track's session gap and pregap (unless logical) before its data,
+// so the address is that of the first of them.
+func WriteGDI(tracks []Track, gdiPath string, binNames []string) (err error) {
+	if len(binNames) != len(tracks) {
+		return fmt.Errorf("%d file names for %d tracks", len(binNames), len(tracks))
+	}
+	for i := 1; i < len(binNames); i++ {
+		if binNames[i] == binNames[i-1] {
+			return fmt.Errorf("tracks %d and %d share %s; a .gdi needs one file per track", tracks[i-1].Num, tracks[i].Num, binNames[i])
+		}
+	}
+
+	out, err := os.Create(TempPath(gdiPath))
+	if err != nil {
+		return fmt.Errorf("Failed to write gdi: %v", err)
+	}
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		closeErr := out.Close()
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("Close failed: %v", closeErr)
+		}
+		err = finishTemp(gdiPath, err, false)
+		if err == nil {
+			Info.Printf("Wrote GDI file: %s", gdiPath)
+		}
+	}()
+
+	bw := bufio.NewWriter(out)
+	fmt.Fprintf(bw, "%d\n", len(tracks))
+	for i, t := range tracks {
+		first := t.Start - t.SessionGap
+		if !t.LogicalPregap {
+			first -= t.Pregap
+		}
+		gdiType := 4
+		if t.Mode == 4 {
+			gdiType = 0
+		}
+		name := filepath.Base(binNames[i])
+		if strings.ContainsAny(name, " \t") {
+			name = `"` + name + `"`
+		}
+		fmt.Fprintf(bw, "%d %d %d %d %s 0\n", t.Num, first, gdiType, BinSector, name)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("Flush failed: %v", err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("Sync failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package pmf
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestGolden converts testdata/small.pmf, a Mode 2 track of one Form 1 and
+// one Form 2 sector followed by one AUDIO_MSB sector, and compares the image
+// and cue sheet with small.bin and small.cue. Run with -update to rewrite
+// them after an intended change to the output.
+func TestGolden(t *testing.T) {
+	in, err := os.Open(filepath.Join("testdata", "small.pmf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks, disc, err := ParseFF(filepath.Join("testdata", "small.pmf.ff"), int(fi.Size()), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "pmf-golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binPath, cuePath := filepath.Join(dir, "small.bin"), filepath.Join(dir, "small.cue")
+	if err := BuildBin(in, tracks, binPath, Options{Disc: disc}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteCue(tracks, cuePath, "small.bin", Options{Disc: disc}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"small.bin", "small.cue"} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		golden := filepath.Join("testdata", name)
+		if *update {
+			if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs from %s (run go test -update if the change is intended)", name, golden)
+		}
+	}
+}
+
+// TestConcurrentByteOrders converts small.pmf, whose audio is AUDIO_MSB, and
+// a copy with the audio swapped to AUDIO_LSB at the same time, several
+// times over. Each conversion takes its byte order from its own Options, so
+// all of them must give small.bin.
+func TestConcurrentByteOrders(t *testing.T) {
+	msbData, err := ioutil.ReadFile(filepath.Join("testdata", "small.pmf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msbFF, err := ioutil.ReadFile(filepath.Join("testdata", "small.pmf.ff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(filepath.Join("testdata", "small.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsbData := append([]byte(nil), msbData...)
+	SwapSamples(lsbData[len(lsbData)-BinSector:])
+	lsbFF := strings.Replace(string(msbFF), "AUDIO_MSB", "AUDIO_LSB", 1)
+
+	type input struct {
+		data   []byte
+		tracks []Track
+		disc   Disc
+	}
+	var inputs []input
+	for _, in := range []struct {
+		data []byte
+		ff   string
+	}{{msbData, string(msbFF)}, {lsbData, lsbFF}} {
+		tracks, disc, err := ParseFFReader(strings.NewReader(in.ff), len(in.data), Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, input{in.data, tracks, disc})
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 16)
+	outs := make([]bytes.Buffer, len(errs))
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			in := inputs[i%len(inputs)]
+			errs[i] = WriteBin(context.Background(), bytes.NewReader(in.data), in.tracks, &outs[i], Options{Disc: in.disc, Workers: 2})
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		order := inputs[i%len(inputs)].disc.AudioMSB
+		if err != nil {
+			t.Errorf("conversion %d (AudioMSB %v): %v", i, order, err)
+		} else if !bytes.Equal(outs[i].Bytes(), want) {
+			t.Errorf("conversion %d (AudioMSB %v) differs from small.bin", i, order)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package pmf
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"hash"
+	"hash/crc32"
+)
+
+// Digest is the size and hashes of the whole BIN image or one track of it.
+type Digest struct {
+	Size  int64
+	CRC32 uint32
+	MD5   []byte
+	SHA1  []byte
+}
+
+// digester accumulates a Digest.
+type digester struct {
+	size  int64
+	crc32 hash.Hash32
+	md5   hash.Hash
+	sha1  hash.Hash
+}
+
+func newDigester() *digester {
+	return &digester{crc32: crc32.NewIEEE(), md5: md5.New(), sha1: sha1.New()}
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	d.crc32.Write(p)
+	d.md5.Write(p)
+	d.sha1.Write(p)
+	return len(p), nil
+}
+
+func (d *digester) digest() Digest {
+	return Digest{Size: d.size, CRC32: d.crc32.Sum32(), MD5: d.md5.Sum(nil), SHA1: d.sha1.Sum(nil)}
+}
+
+// Hasher hashes a BIN image as it is written, both as a whole and per track.
+// Pass it as Options.Tee so the image does not have to be read back. Each
+// track's range includes its pregap, as in a per-track split of the image.
+type Hasher struct {
+	image  *digester
+	tracks []*digester
+	sizes  []int64 // bytes per track in the image
+	cur    int     // track currently being written
+}
+
+// NewHasher returns a Hasher for the image of tracks.
+func NewHasher(tracks []Track) *Hasher {
+	h := &Hasher{image: newDigester()}
+	for _, t := range tracks {
+		h.tracks = append(h.tracks, newDigester())
+		h.sizes = append(h.sizes, int64(t.ImageSectors())*BinSector)
+	}
+	return h
+}
+
+// Write hashes the next bytes of the image.
+func (h *Hasher) Write(p []byte) (int, error) {
+	h.image.Write(p)
+	rest := p
+	for len(rest) > 0 && h.cur < len(h.tracks) {
+		d := h.tracks[h.cur]
+		n := h.sizes[h.cur] - d.size
+		if n > int64(len(rest)) {
+			n = int64(len(rest))
+		}
+		d.Write(rest[:n])
+		rest = rest[n:]
+		if d.size == h.sizes[h.cur] {
+			h.cur++
+		}
+	}
+	return len(p), nil
+}
+
+// Image returns the digest of everything written so far.
+func (h *Hasher) Image() Digest {
+	return h.image.digest()
+}
+
+// Tracks returns the digest of each track.
+func (h *Hasher) Tracks() []Digest {
+	var digests []Digest
+	for _, d := range h.tracks {
+		digests = append(digests, d.digest())
+	}
+	return digests
+}
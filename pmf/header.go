@@ -0,0 +1,57 @@
+package pmf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// LayoutHeaderMagic begins a PMF that carries its own track table in a
+// layout header, instead of in a .pmf.ff beside it. The header is laid out
+// as follows, with the PMF data following it:
+//
+//	0   6 bytes  "PMFHDR"
+//	6   2 bytes  version, little-endian: 1
+//	8   4 bytes  header length in bytes, little-endian, counting from 0
+//	12  ...      the track table in .pmf.ff syntax, padded with NUL bytes
+const LayoutHeaderMagic = "PMFHDR"
+
+const (
+	layoutHeaderVersion = 1
+	layoutHeaderFixed   = 12      // magic, version and length
+	maxLayoutHeader     = 1 << 20 // far more than any track table needs
+)
+
+// ReadLayoutHeader reads the layout header at the start of the PMF in r, if
+// it begins with LayoutHeaderMagic, and returns the track table it holds,
+// for ParseFFReader, and the length of the header. A PMF without the magic
+// gives a length of 0, and nothing is read from r beyond what it buffers.
+func ReadLayoutHeader(r *bufio.Reader) (layout []byte, n int, err error) {
+	fixed, err := r.Peek(layoutHeaderFixed)
+	if !bytes.HasPrefix(fixed, []byte(LayoutHeaderMagic)) {
+		if err != nil && err != io.EOF {
+			return nil, 0, ioError(err, "error reading PMF: %v", err)
+		}
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, newError(ErrSyntax, "layout header truncated")
+	}
+
+	if v := binary.LittleEndian.Uint16(fixed[6:]); v != layoutHeaderVersion {
+		return nil, 0, newError(ErrSyntax, "unsupported layout header version %d", v)
+	}
+	size := binary.LittleEndian.Uint32(fixed[8:])
+	if size < layoutHeaderFixed || size > maxLayoutHeader {
+		return nil, 0, newError(ErrSyntax, "layout header length %d out of range", size)
+	}
+	header := make([]byte, size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, 0, newError(ErrSyntax, "layout header truncated: %d bytes expected", size)
+		}
+		return nil, 0, ioError(err, "error reading PMF: %v", err)
+	}
+	return bytes.TrimRight(header[layoutHeaderFixed:], "\x00"), int(size), nil
+}
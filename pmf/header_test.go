@@ -0,0 +1,91 @@
+package pmf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestReadLayoutHeader reads testdata/header.pmf, which is small.pmf behind
+// a layout header holding small.pmf.ff.
+func TestReadLayoutHeader(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "header.pmf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ff, err := ioutil.ReadFile(filepath.Join("testdata", "small.pmf.ff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := ioutil.ReadFile(filepath.Join("testdata", "small.pmf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	layout, n, err := ReadLayoutHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data)-len(small) {
+		t.Errorf("header length %d, want %d", n, len(data)-len(small))
+	}
+	if !bytes.Equal(layout, ff) {
+		t.Errorf("layout %q, want %q", layout, ff)
+	}
+	if rest, _ := ioutil.ReadAll(r); !bytes.Equal(rest, small) {
+		t.Error("PMF data after the header differs from small.pmf")
+	}
+
+	tracks, disc, err := ParseFFReader(bytes.NewReader(layout), len(small), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, wantDisc, err := ParseFF(filepath.Join("testdata", "small.pmf.ff"), len(small), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTracks(t, tracks, want)
+	if disc != wantDisc {
+		t.Errorf("disc %+v, want %+v", disc, wantDisc)
+	}
+
+	// Without the magic nothing is consumed
+	r = bufio.NewReader(bytes.NewReader(small))
+	if layout, n, err := ReadLayoutHeader(r); err != nil || n != 0 || layout != nil {
+		t.Errorf("small.pmf: layout %q, length %d, error %v", layout, n, err)
+	}
+	if rest, _ := ioutil.ReadAll(r); !bytes.Equal(rest, small) {
+		t.Error("small.pmf: data consumed without a header")
+	}
+}
+
+func TestReadLayoutHeaderInvalid(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "header.pmf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := int(binary.LittleEndian.Uint32(data[8:]))
+	modified := func(off int, v []byte) []byte {
+		b := append([]byte(nil), data...)
+		copy(b[off:], v)
+		return b
+	}
+	for name, in := range map[string][]byte{
+		"version 2":        modified(6, []byte{2, 0}),
+		"length too short": modified(8, []byte{11, 0, 0, 0}),
+		"length too long":  modified(8, []byte{0, 0, 0x10, 1}),
+		"truncated fixed":  data[:10],
+		"truncated table":  data[:n-1],
+		"magic only":       []byte(LayoutHeaderMagic),
+	} {
+		_, _, err := ReadLayoutHeader(bufio.NewReader(bytes.NewReader(in)))
+		if !errors.Is(err, ErrSyntax) {
+			t.Errorf("%s: error %v, want %v", name, err, ErrSyntax)
+		}
+	}
+}
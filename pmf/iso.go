@@ -0,0 +1,91 @@
+package pmf
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+)
+
+// ISOSector is the size of a sector in a flat ISO image: the 2048 bytes of
+// user data of a Mode 1 or Mode 2 Form 1 sector.
+const ISOSector = 2048
+
+// BuildISO writes the user data of the image of tracks to outPath as a flat
+// ISO image, one 2048-byte block per sector of the BIN image that BuildBin
+// would write, pregaps as zero blocks. Only data tracks can be written this
+// way: audio tracks and Mode 2 Form 2 sectors are errors. As with
+// BuildBinContext, the image is written under TempPath(outPath) and renamed
+// once complete.
+func BuildISO(ctx context.Context, pmf io.Reader, tracks []Track, outPath string, opts Options) (err error) {
+	out, err := os.Create(TempPath(outPath))
+	if err != nil {
+		return ioError(err, "Failed to create %s: %v", TempPath(outPath), err)
+	}
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		closeErr := out.Close()
+		if err == nil && closeErr != nil {
+			err = ioError(closeErr, "Close failed: %v", closeErr)
+		}
+		err = finishTemp(outPath, err, opts.KeepPartial)
+		if err == nil {
+			Info.Printf("Wrote ISO image: %s", outPath)
+		}
+	}()
+	if err := WriteISO(ctx, pmf, tracks, out, opts); err != nil {
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		return ioError(err, "Sync failed: %v", err)
+	}
+	return nil
+}
+
+// WriteISO is like BuildISO but writes the ISO image to w.
+func WriteISO(ctx context.Context, pmf io.Reader, tracks []Track, w io.Writer, opts Options) error {
+	for _, t := range tracks {
+		if t.Mode == 4 {
+			return newError(ErrInvalidMode, "track %d is audio, which an ISO image cannot hold", t.Num)
+		}
+	}
+
+	br := bufio.NewReader(pmf)
+	if opts.Tee != nil {
+		w = io.MultiWriter(w, opts.Tee)
+	}
+	bw := bufio.NewWriter(w)
+
+	// Stop reading at the first sector that cannot be written
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var form2 error
+	var zero [ISOSector]byte
+	err := readSectors(ctx, br, tracks, opts, func(j *sectorJob) {
+		switch {
+		case form2 != nil:
+		case j.pregap:
+			bw.Write(zero[:])
+		case j.mode == 1:
+			bw.Write(j.raw[:ISOSector])
+		case IsForm2(j.raw[:8]):
+			lba := j.lba - opts.leadIn()
+			form2 = newError(ErrInvalidMode, "sector %d (%s) is Mode 2 Form 2, which an ISO image cannot hold", lba, LBAToMSFFormatted(lba))
+			cancel()
+		default:
+			bw.Write(j.raw[8 : 8+ISOSector])
+		}
+	})
+	if form2 != nil {
+		return form2
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return ioError(err, "Flush failed: %v", err)
+	}
+	return checkConsumed(br, tracks, opts)
+}
@@ -0,0 +1,79 @@
+package pmf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// trackMode describes one of the track mode codes of the .pmf.ff track table:
+// how its sectors are stored in the PMF and how the track is declared in the
+// files written alongside the BIN image. Supporting another kind of track
+// starts with an entry here.
+type trackMode struct {
+	code      int    // mode number in the .pmf.ff
+	name      string // name in progress output
+	pmfSector int    // PMF bytes per sector (Mode 2: per Form 1 sector)
+	cueType   string // cue sheet TRACK type
+	cueSub    string // cue sheet TRACK type with interleaved subchannel data
+	tocType   string // cdrdao TRACK mode
+	ccdMode   int    // CloneCD MODE
+}
+
+// trackModes lists the supported track modes in .pmf.ff code order.
+var trackModes = []trackMode{
+	{code: 1, name: "MODE1", pmfSector: PMFMode1Sector, cueType: "MODE1/2352", cueSub: "MODE1/2448", tocType: "MODE1_RAW", ccdMode: 1},
+	{code: 2, name: "MODE2", pmfSector: PMFSector, cueType: "MODE2/2352", cueSub: "MODE2/2448", tocType: "MODE2_RAW", ccdMode: 2},
+	{code: 4, name: "AUDIO", pmfSector: BinSector, cueType: "AUDIO", cueSub: "CDG", tocType: "AUDIO", ccdMode: 0},
+}
+
+// lookupMode returns the description of a .pmf.ff mode code.
+func lookupMode(code int) (trackMode, bool) {
+	for _, m := range trackModes {
+		if m.code == code {
+			return m, true
+		}
+	}
+	return trackMode{}, false
+}
+
+// modeOf returns the description of a validated track's mode. Tracks from
+// ParseFF or ParseCue always have a supported mode; anything else is treated
+// as Mode 2, as it always has been.
+func modeOf(code int) trackMode {
+	if m, ok := lookupMode(code); ok {
+		return m
+	}
+	m, _ := lookupMode(2)
+	return m
+}
+
+// modeForCueType returns the .pmf.ff mode code for a cue sheet TRACK type.
+func modeForCueType(cueType string) (int, bool) {
+	for _, m := range trackModes {
+		if strings.EqualFold(m.cueType, cueType) {
+			return m.code, true
+		}
+	}
+	return 0, false
+}
+
+// isSubCueType reports whether cueType is one of the TRACK types of an image
+// with interleaved subchannel data, as written with Options.SubInterleaved.
+func isSubCueType(cueType string) bool {
+	for _, m := range trackModes {
+		if strings.EqualFold(m.cueSub, cueType) {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedModes lists the supported mode codes for error messages, such as
+// "1 (MODE1), 2 (MODE2), 4 (AUDIO)".
+func supportedModes() string {
+	var list []string
+	for _, m := range trackModes {
+		list = append(list, fmt.Sprintf("%d (%s)", m.code, m.name))
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,84 @@
+package pmf
+
+import "fmt"
+
+// toBCD packs a value from 0 to 99 into a binary-coded decimal byte. Larger
+// values cannot be represented and panic rather than wrap silently; the
+// exported functions that use it check their arguments and return an error
+// first.
+func toBCD(value int) byte {
+	if value < 0 || value > 99 {
+		panic(fmt.Sprintf("pmf: %d out of BCD range", value))
+	}
+	return byte((value/10)<<4 | (value % 10))
+}
+
+// fromBCD unpacks a binary-coded decimal byte, reporting false if either
+// digit is above 9.
+func fromBCD(b byte) (int, bool) {
+	hi, lo := int(b>>4), int(b&0x0F)
+	if hi > 9 || lo > 9 {
+		return 0, false
+	}
+	return hi*10 + lo, true
+}
+
+// StandardLeadIn is the lead-in offset used by the CD standards: the 150
+// sectors (2 seconds) between the start of the disc's program area and its
+// first sector at 00:00:00 in the image.
+//
+// Positions in a BIN image and its cue sheet count from 00:00:00 without it;
+// the addresses in sector headers and the absolute times in the subchannel
+// count from the start of the program area, so they add the lead-in. The MSF
+// helpers below apply no offset, and callers add the lead-in where it
+// belongs. Some premastering conventions use another offset, set with
+// Options.LeadIn.
+const StandardLeadIn = 150
+
+// NoLeadIn, as Options.LeadIn, selects a lead-in offset of 0 sectors.
+const NoLeadIn = -1
+
+// Disc capacities in sectors, lead-in included. An 80-minute disc is the
+// largest standard size; MaxDiscSectors is the limit of an MSF address
+// (99:59:74), reached only by overburned or oversized media.
+const (
+	Disc80Sectors  = 80 * 60 * 75
+	MaxDiscSectors = 100 * 60 * 75
+)
+
+// MaxTracks is the most tracks a disc can hold: track numbers are two BCD
+// digits, 01 to 99.
+const MaxTracks = 99
+
+// LBAToMSF splits a sector address into minutes, seconds and frames
+// (75 frames per second).
+func LBAToMSF(lba int) (int, int, int) {
+	min := lba / (60 * 75)
+	sec := (lba / 75) % 60
+	frame := lba % 75
+	return min, sec, frame
+}
+
+// parseMSF converts an mm:ss:ff time into a sector count.
+func parseMSF(s string) (int, error) {
+	var min, sec, frame int
+	if _, err := fmt.Sscanf(s, "%d:%d:%d", &min, &sec, &frame); err != nil {
+		return 0, fmt.Errorf("invalid MSF time %q", s)
+	}
+	if min < 0 || sec < 0 || sec >= 60 || frame < 0 || frame >= 75 {
+		return 0, fmt.Errorf("invalid MSF time %q", s)
+	}
+	return MSFToLBA(min, sec, frame), nil
+}
+
+// MSFToLBA converts minutes, seconds and frames back into a sector address,
+// the inverse of LBAToMSF.
+func MSFToLBA(min, sec, frame int) int {
+	return (min*60+sec)*75 + frame
+}
+
+// LBAToMSFFormatted renders a sector address as mm:ss:ff.
+func LBAToMSFFormatted(lba int) string {
+	min, sec, frame := LBAToMSF(lba)
+	return fmt.Sprintf("%02d:%02d:%02d", min, sec, frame)
+}
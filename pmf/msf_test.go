@@ -0,0 +1,119 @@
+package pmf
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLBAToMSFRoundTrip(t *testing.T) {
+	for lba := 0; lba < MaxDiscSectors; lba++ {
+		min, sec, frame := LBAToMSF(lba)
+		if min > 99 || sec > 59 || frame > 74 {
+			t.Fatalf("LBAToMSF(%d) = %d:%d:%d, out of range", lba, min, sec, frame)
+		}
+		if got := MSFToLBA(min, sec, frame); got != lba {
+			t.Fatalf("MSFToLBA(LBAToMSF(%d)) = %d", lba, got)
+		}
+	}
+}
+
+func TestParseMSFRoundTrip(t *testing.T) {
+	for _, lba := range []int{0, 1, 74, 75, 150, 4499, 4500, Disc80Sectors - 1, MaxDiscSectors - 1} {
+		s := LBAToMSFFormatted(lba)
+		got, err := parseMSF(s)
+		if err != nil || got != lba {
+			t.Errorf("parseMSF(%q) = %d, %v; want %d", s, got, err, lba)
+		}
+	}
+	if s := LBAToMSFFormatted(MaxDiscSectors - 1); s != "99:59:74" {
+		t.Errorf("last address is %s, want 99:59:74", s)
+	}
+	for _, s := range []string{"00:60:00", "00:00:75", "-1:00:00", "1:2"} {
+		if _, err := parseMSF(s); err == nil {
+			t.Errorf("parseMSF(%q) accepted", s)
+		}
+	}
+}
+
+func TestSectorHeaderRange(t *testing.T) {
+	header, err := SectorHeader(MaxDiscSectors-1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [4]byte{0x99, 0x59, 0x74, 1}; header != want {
+		t.Errorf("header % x, want % x", header, want)
+	}
+	for _, lba := range []int{-1, MaxDiscSectors} {
+		if _, err := SectorHeader(lba, 1); err == nil {
+			t.Errorf("SectorHeader(%d) accepted", lba)
+		}
+	}
+}
+
+func TestSubcodeRange(t *testing.T) {
+	track := Track{Num: 1, Mode: 1, Start: 0, End: 100}
+	if _, err := Subcode(track, MaxDiscSectors-StandardLeadIn-1, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Subcode(track, MaxDiscSectors-StandardLeadIn, Options{}); err == nil {
+		t.Error("Subcode accepted a position past 99:59:74")
+	}
+	track.Num = 100
+	if _, err := Subcode(track, 0, Options{}); err == nil {
+		t.Error("Subcode accepted track 100")
+	}
+}
+
+// TestLeadIn converts small.pmf with three lead-in offsets and checks that
+// the sector headers and subchannel times move with it while the rest of
+// the sector stays the same.
+func TestLeadIn(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "small.pmf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks, disc, err := ParseFF(filepath.Join("testdata", "small.pmf.ff"), len(data), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var base []byte
+	for _, tt := range []struct {
+		leadIn int
+		header [2]byte // minute and second of the header of sector 1
+	}{
+		{NoLeadIn, [2]byte{0x00, 0x00}},
+		{0, [2]byte{0x00, 0x02}},
+		{StandardLeadIn, [2]byte{0x00, 0x02}},
+		{300, [2]byte{0x00, 0x04}},
+	} {
+		opts := Options{Disc: disc, LeadIn: tt.leadIn}
+		var out bytes.Buffer
+		if err := WriteBin(context.Background(), bytes.NewReader(data), tracks, &out, opts); err != nil {
+			t.Fatalf("lead-in %d: %v", tt.leadIn, err)
+		}
+		image := out.Bytes()
+		sector := image[BinSector : 2*BinSector]
+		if want := []byte{tt.header[0], tt.header[1], 0x01, 0x02}; !bytes.Equal(sector[12:16], want) {
+			t.Errorf("lead-in %d: header % X, want % X", tt.leadIn, sector[12:16], want)
+		}
+		if tail := sector[16:]; base == nil {
+			base = tail
+		} else if !bytes.Equal(tail, base) {
+			t.Errorf("lead-in %d: sector 1 changed past its header", tt.leadIn)
+		}
+		if info := InspectSector(sector, opts); info.Address != 1 {
+			t.Errorf("lead-in %d: InspectSector gives address %d, want 1", tt.leadIn, info.Address)
+		}
+
+		sub, err := Subcode(tracks[0], 1, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sub[12+7 : 12+10]; !bytes.Equal(got, []byte{tt.header[0], tt.header[1], 0x01}) {
+			t.Errorf("lead-in %d: absolute subchannel time % X, want %02X %02X 01", tt.leadIn, got, tt.header[0], tt.header[1])
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package pmf
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReadPatchList reads a list of deliberately corrupted sectors, as found on
+// copy-protected discs, for Options.Patches. Each line has the form
+//
+//	LBA: bytes
+//
+// where LBA is the sector's position in the BIN image (as reported by
+// VerifyBin) and bytes is hex, optionally separated by spaces, to write over
+// the sector's EDC and, if longer, the parity after it. Blank lines and
+// lines starting with '#' are ignored.
+func ReadPatchList(path string) (map[int][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, ioError(err, "failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	patches := make(map[int][]byte)
+	lineNum := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Split(scanLines)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			return nil, newError(ErrSyntax, "%s line %d: expected \"LBA: bytes\"", path, lineNum)
+		}
+		lba, err := strconv.Atoi(strings.TrimSpace(line[:colon]))
+		if err != nil || lba < 0 {
+			return nil, newError(ErrSyntax, "%s line %d: invalid LBA %q", path, lineNum, strings.TrimSpace(line[:colon]))
+		}
+		b, err := hex.DecodeString(strings.Join(strings.Fields(line[colon+1:]), ""))
+		if err != nil || len(b) == 0 {
+			return nil, newError(ErrSyntax, "%s line %d: invalid patch bytes %q", path, lineNum, strings.TrimSpace(line[colon+1:]))
+		}
+		if _, dup := patches[lba]; dup {
+			return nil, newError(ErrSyntax, "%s line %d: duplicate patch for LBA %d", path, lineNum, lba)
+		}
+		patches[lba] = b
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, ioError(err, "error reading %s: %v", path, err)
+	}
+	return patches, nil
+}
+
+// edcOffset returns where the EDC of a data sector starts in the BIN sector:
+// after the user data of Mode 1 and Mode 2 Form 1 sectors, and in the last
+// four bytes of Form 2 sectors.
+func (j *sectorJob) edcOffset() int {
+	switch {
+	case j.mode == 1:
+		return 2064
+	case j.mode == 2 && !j.pregap && j.size == PMFForm2Sector:
+		return 2348
+	}
+	return 2072
+}
+
+// checkPatch validates a patch for j, which is at position pos in the image.
+func (j *sectorJob) checkPatch(pos int, patch []byte) error {
+	if j.mode == 4 {
+		return fmt.Errorf("patch for LBA %d: the sector is audio and has no EDC", pos)
+	}
+	if room := BinSector - j.edcOffset(); len(patch) > room {
+		return fmt.Errorf("patch for LBA %d: %d bytes, but only %d fit after the EDC offset", pos, len(patch), room)
+	}
+	return nil
+}
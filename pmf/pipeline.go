@@ -0,0 +1,173 @@
+package pmf
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// DefaultBufferSectorsPerWorker is the number of sectors per worker that a
+// Pipeline keeps in flight when BufferSectors is zero.
+const DefaultBufferSectorsPerWorker = 16
+
+// Pipeline converts a PMF into a BIN image in three stages: a reader that
+// splits the PMF into sectors following the track layout, Workers encoders
+// that turn them into finished 2352-byte sectors, and a writer that emits the
+// sectors in their original order. At most BufferSectors sectors are read
+// but not yet written at any time, so memory use is bounded regardless of
+// the image size, and the reader waits when the encoders or the output fall
+// behind. The output is the same for any number of Workers, and so is the
+// order of the per-track log lines, which come from the reader alone.
+type Pipeline struct {
+	// Workers is the number of encoder goroutines. Zero uses
+	// runtime.NumCPU(); 1 reads, encodes and writes each sector in turn.
+	Workers int
+
+	// BufferSectors is the number of sectors, about 4.6 KiB each, that may
+	// be in flight between the reader and the writer. Zero uses
+	// DefaultBufferSectorsPerWorker for each worker.
+	BufferSectors int
+}
+
+// Run writes the BIN image for the PMF data read from pmf and the given
+// track layout to w, as described for WriteBin. Options other than Workers
+// and BufferSectors are taken from opts.
+func (p Pipeline) Run(ctx context.Context, pmf io.Reader, tracks []Track, w io.Writer, opts Options) error {
+	if !opts.ByteOrderDeclared && hasAudio(tracks) {
+		opts.AudioMSB = detectByteOrder(pmf, tracks)
+	}
+
+	total := -opts.StartSector // sectors to write
+	for _, t := range tracks {
+		total += t.ImageSectors()
+	}
+
+	br := bufio.NewReader(pmf)
+	if opts.Tee != nil {
+		w = io.MultiWriter(w, opts.Tee)
+	}
+	if opts.Progress != nil {
+		w = &progressWriter{w: w, size: int64(opts.sectorSize()), total: total, report: opts.Progress}
+	}
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	var subs *subcodeStream
+	if opts.SubInterleaved {
+		subs = newSubcodeStream(tracks, opts)
+		for s := 0; s < opts.StartSector; s++ {
+			subs.next()
+		}
+	}
+
+	var stats edcStats
+	write := func(j *sectorJob) {
+		stats.add(j)
+		bw.Write(j.out[:])
+		if subs != nil {
+			sub := InterleaveSubcode(subs.next())
+			bw.Write(sub[:])
+		}
+	}
+	var err error
+	if workers := p.workers(); workers == 1 {
+		err = readSectors(ctx, br, tracks, opts, func(j *sectorJob) {
+			j.encode()
+			write(j)
+		})
+	} else {
+		err = p.encodeParallel(ctx, br, tracks, opts, workers, write)
+	}
+	if err != nil {
+		return err
+	}
+	stats.report(opts)
+	if opts.Stats != nil {
+		*opts.Stats = Stats{DataSectors: stats.sectors, ZeroEDCSectors: stats.zero, AudioMSB: opts.AudioMSB}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return ioError(err, "Flush failed: %v", err)
+	}
+	if err := checkConsumed(br, tracks, opts); err != nil {
+		return err
+	}
+
+	// The output side of checkConsumed: a sector dropped or repeated, say by
+	// miscounting a pregap, leaves the image the wrong size
+	if want := int64(total) * int64(opts.sectorSize()); cw.n != want {
+		return newError(ErrImageSize, "wrote %d bytes of BIN image, expected %d (%d sectors)", cw.n, want, total)
+	}
+	return nil
+}
+
+// workers returns the number of encoder goroutines to run.
+func (p Pipeline) workers() int {
+	if p.Workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return p.Workers
+}
+
+// bufferSectors returns the bound on sectors in flight for workers encoders.
+func (p Pipeline) bufferSectors(workers int) int {
+	if p.BufferSectors <= 0 {
+		return workers * DefaultBufferSectorsPerWorker
+	}
+	return p.BufferSectors
+}
+
+// encodeParallel encodes the sectors produced by readSectors on a pool of
+// workers while a writer goroutine passes the finished sectors to write in
+// their original order.
+func (p Pipeline) encodeParallel(ctx context.Context, br *bufio.Reader, tracks []Track, opts Options, workers int, write func(j *sectorJob)) error {
+	buffer := p.bufferSectors(workers)
+	jobs := make(chan *sectorJob, workers*2)
+	done := make(chan *sectorJob, workers*2)
+	// window bounds the number of sectors read but not yet written
+	window := make(chan struct{}, buffer)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				j.encode()
+				done <- j
+			}
+		}()
+	}
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		pending := make(map[int]*sectorJob)
+		next := 0
+		for j := range done {
+			pending[j.seq] = j
+			for s, ok := pending[next]; ok; s, ok = pending[next] {
+				write(s)
+				delete(pending, next)
+				next++
+				<-window
+			}
+		}
+	}()
+
+	seq := 0
+	err := readSectors(ctx, br, tracks, opts, func(j *sectorJob) {
+		window <- struct{}{}
+		j.seq = seq
+		seq++
+		jobs <- j
+	})
+
+	close(jobs)
+	wg.Wait()
+	close(done)
+	<-written
+	return err
+}
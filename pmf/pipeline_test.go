@@ -0,0 +1,180 @@
+package pmf
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// pipelineFF lays out a Mode 1 track, a Mode 2 track alternating Form 1 and
+// Form 2 sectors, and an audio track, each 100 sectors long.
+const pipelineFF = "AUDIO_BYTE_ORDER: AUDIO_LSB\n" +
+	"%START_OF_ADDED_TRACK_DATA\n" +
+	"1 1 0 99\n" +
+	"2 2 250 349\n" +
+	"3 4 500 599\n"
+
+// pipelinePMF returns random PMF data for pipelineFF.
+func pipelinePMF() []byte {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+
+	var pmf []byte
+	pmf = append(pmf, random(100*PMFMode1Sector)...)
+	for s := 0; s < 100; s++ {
+		if s%2 == 0 {
+			pmf = append(pmf, 0, 0, 0x08, 0, 0, 0, 0x08, 0)
+			pmf = append(pmf, random(PMFSector-8)...)
+		} else {
+			pmf = append(pmf, 0, 0, 0x20, 0, 0, 0, 0x20, 0)
+			pmf = append(pmf, random(PMFForm2Sector-8)...)
+		}
+	}
+	return append(pmf, random(100*BinSector)...)
+}
+
+// TestPipelineWorkers checks that the image does not depend on the number of
+// encoders or the bound on sectors in flight. Run it with
+// go test -race ./pmf/ to also check the pipeline for data races.
+func TestPipelineWorkers(t *testing.T) {
+	data := pipelinePMF()
+	tracks, disc, err := ParseFFReader(strings.NewReader(pipelineFF), len(data), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []byte
+	for _, p := range []Pipeline{
+		{Workers: 1},
+		{Workers: 4},
+		{Workers: 16},
+		{Workers: 16, BufferSectors: 1},
+	} {
+		var out bytes.Buffer
+		if err := p.Run(context.Background(), bytes.NewReader(data), tracks, &out, Options{Disc: disc}); err != nil {
+			t.Fatalf("%d workers, buffer %d: %v", p.Workers, p.BufferSectors, err)
+		}
+		if want == nil {
+			want = out.Bytes()
+			if n := len(want) / BinSector; n != 600 {
+				t.Fatalf("%d sectors written, want 600", n)
+			}
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("%d workers, buffer %d: image differs from 1 worker", p.Workers, p.BufferSectors)
+		}
+	}
+}
+
+// zeroForm1EDC is the EDC of a Mode 2 Form 1 data sector (subheader
+// 00 00 08 00) holding 2048 zero bytes.
+var zeroForm1EDC = []byte{0x0B, 0x88, 0x81, 0x94}
+
+// TestPregapSectors checks the generated pregap of a Mode 2 track: complete
+// Form 1 sectors of zero data by default, sync and header only with
+// BlankPregap.
+func TestPregapSectors(t *testing.T) {
+	data := pipelinePMF()
+	ff := strings.Replace(pipelineFF, "%START", "%PREGAP 2 2\n%START", 1)
+	tracks, disc, err := ParseFFReader(strings.NewReader(ff), len(data), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracks[1].Pregap != 2 {
+		t.Fatalf("track 2 pregap %d, want 2", tracks[1].Pregap)
+	}
+
+	for _, blank := range []bool{false, true} {
+		var out bytes.Buffer
+		opts := Options{Disc: disc, BlankPregap: blank}
+		if err := WriteBin(context.Background(), bytes.NewReader(data), tracks, &out, opts); err != nil {
+			t.Fatalf("BlankPregap %v: %v", blank, err)
+		}
+		image := out.Bytes()
+		for lba := tracks[1].Start - 2; lba < tracks[1].Start; lba++ {
+			sector := image[lba*BinSector : (lba+1)*BinSector]
+			header := sectorHeader(lba+StandardLeadIn, 2)
+			if !bytes.Equal(sector[0:12], syncPattern[:]) || !bytes.Equal(sector[12:16], header[:]) {
+				t.Errorf("BlankPregap %v: sector %d: sync and header % X, want % X", blank, lba, sector[0:16], append(syncPattern[:], header[:]...))
+				continue
+			}
+			if blank {
+				if !bytes.Equal(sector[16:], make([]byte, BinSector-16)) {
+					t.Errorf("BlankPregap %v: sector %d is not zero past the header", blank, lba)
+				}
+				continue
+			}
+			if got := sector[2072:2076]; !bytes.Equal(got, zeroForm1EDC) {
+				t.Errorf("sector %d: EDC % X, want % X", lba, got, zeroForm1EDC)
+			}
+			if c := CheckSector(sector); !c.Checked || !c.OK() {
+				t.Errorf("sector %d fails its EDC/ECC check: %+v", lba, c)
+			}
+		}
+	}
+}
+
+// TestSubheaderCopies converts a Mode 2 track whose first sector has matching
+// subheader copies and whose second does not, checking the warning and the
+// written subheader with Strict and with RepairSubheader.
+func TestSubheaderCopies(t *testing.T) {
+	equal := []byte{0x00, 0x01, 0x08, 0x00, 0x00, 0x01, 0x08, 0x00}
+	mismatched := []byte{0x00, 0x01, 0x08, 0x00, 0x00, 0x02, 0x08, 0x00}
+	var data []byte
+	for _, subheader := range [][]byte{equal, mismatched} {
+		data = append(data, subheader...)
+		data = append(data, make([]byte, PMFSector-8)...)
+	}
+	tracks, disc, err := ParseFFReader(strings.NewReader("%START_OF_ADDED_TRACK_DATA\n1 2 0 1\n"), len(data), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := Warn.Writer()
+	defer Warn.SetOutput(w)
+	for _, tt := range []struct {
+		name   string
+		opts   Options
+		warn   string // expected warning, "" for none
+		second []byte // subheader written for the second sector
+	}{
+		{"default", Options{}, "", mismatched},
+		{"strict", Options{Strict: true}, "sector 1 (00:00:01): subheader copies differ", mismatched},
+		{"repair", Options{RepairSubheader: true}, "sector 1 (00:00:01): subheader copies differ (00 01 08 00 00 02 08 00); repaired", equal},
+	} {
+		var warnings bytes.Buffer
+		Warn.SetOutput(&warnings)
+		var out bytes.Buffer
+		opts := tt.opts
+		opts.Disc = disc
+		if err := WriteBin(context.Background(), bytes.NewReader(data), tracks, &out, opts); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		image := out.Bytes()
+
+		if got := image[16:24]; !bytes.Equal(got, equal) {
+			t.Errorf("%s: sector 0 subheader % X, want % X", tt.name, got, equal)
+		}
+		if got := image[BinSector+16 : BinSector+24]; !bytes.Equal(got, tt.second) {
+			t.Errorf("%s: sector 1 subheader % X, want % X", tt.name, got, tt.second)
+		}
+		if c := CheckSector(image[BinSector : 2*BinSector]); !c.Checked || !c.OK() {
+			t.Errorf("%s: sector 1 fails its EDC/ECC check: %+v", tt.name, c)
+		}
+		switch got := warnings.String(); {
+		case tt.warn == "" && got != "":
+			t.Errorf("%s: unexpected warning %q", tt.name, got)
+		case tt.warn != "" && !strings.Contains(got, tt.warn):
+			t.Errorf("%s: warning %q, want it to contain %q", tt.name, got, tt.warn)
+		case strings.Contains(got, "sector 0"):
+			t.Errorf("%s: warning about sector 0, whose copies match: %q", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+// Package pmf converts Kodak PhotoCD Premaster Files (.pmf / .pmf.ff) into
+// raw 2352-byte BIN images with a matching CUE sheet.
+//
+// The sector encoder (EDC and Reed-Solomon P/Q parity) is exported so it can
+// be used on individual sectors without touching the filesystem.
+package pmf
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+// Track describes one track entry from the .pmf.ff track table.
+type Track struct {
+	Num    int `json:"num"`
+	Mode   int `json:"mode"`
+	Start  int `json:"start"`
+	End    int `json:"end"`
+	Pregap int `json:"pregap"` // number of sectors in pregap (INDEX 00)
+
+	// LogicalPregap omits the pregap sectors from the BIN image; the cue
+	// sheet declares them with PREGAP instead of INDEX 00.
+	LogicalPregap bool `json:"logicalPregap,omitempty"`
+
+	// Gapless marks a track without a pregap whose cue sheet entry still
+	// has an INDEX 00, at the same time as INDEX 01, as on discs whose
+	// tracks run into each other. It adds no sectors to the image.
+	Gapless bool `json:"gapless,omitempty"`
+
+	// Session is the session the track belongs to, starting at 1. The first
+	// track of every later session is preceded by SessionGap sectors
+	// standing in for the lead-out and lead-in between the sessions.
+	Session    int `json:"session"`
+	SessionGap int `json:"sessionGap,omitempty"`
+
+	ISRC      string `json:"isrc,omitempty"` // International Standard Recording Code
+	Title     string `json:"title,omitempty"`
+	Performer string `json:"performer,omitempty"`
+}
+
+// imageStarts returns the position of each track's INDEX 01 within the BIN
+// image, which is earlier than Start once logical pregaps have been left out.
+func imageStarts(tracks []Track) []int {
+	starts := make([]int, len(tracks))
+	skipped := 0
+	for i, t := range tracks {
+		if t.LogicalPregap {
+			skipped += t.Pregap
+		}
+		starts[i] = t.Start - skipped
+	}
+	return starts
+}
+
+// ImageSectors returns the number of sectors t occupies in the BIN image:
+// its data, any session gap before it and its pregap unless logical.
+func (t Track) ImageSectors() int {
+	sectors := t.SessionGap + t.End - t.Start + 1
+	if !t.LogicalPregap {
+		sectors += t.Pregap
+	}
+	return sectors
+}
+
+// TOC summarizes the table of contents of a disc: the numbers of its first
+// and last tracks and where the lead-out starts.
+type TOC struct {
+	FirstTrack int `json:"firstTrack"`
+	LastTrack  int `json:"lastTrack"`
+
+	// LeadOut is the logical address of the lead-out, the sector after the
+	// end of the last track; LeadOutMSF is its absolute disc time, with the
+	// lead-in added, as burners and the CloneCD A2 point give it.
+	LeadOut    int    `json:"leadOut"`
+	LeadOutMSF string `json:"leadOutMSF"`
+}
+
+// DiscTOC returns the TOC of tracks, a layout as parsed by ParseFF, with the
+// lead-in of opts.
+func DiscTOC(tracks []Track, opts Options) TOC {
+	first, last := tracks[0], tracks[len(tracks)-1]
+	return TOC{
+		FirstTrack: first.Num,
+		LastTrack:  last.Num,
+		LeadOut:    last.End + 1,
+		LeadOutMSF: LBAToMSFFormatted(last.End + 1 + opts.leadIn()),
+	}
+}
+
+// Options controls optional conversion behaviour. The zero value selects
+// the defaults.
+type Options struct {
+	// Disc is what the layout declares about the disc as a whole, as
+	// returned by ParseFF or ParseCueLayout. Its fields are promoted, so
+	// opts.AudioMSB is opts.Disc.AudioMSB.
+	Disc
+
+	// Workers is the number of goroutines encoding sectors in parallel.
+	// Zero uses runtime.NumCPU(); 1 encodes serially.
+	Workers int
+
+	// LeadIn is the offset, in sectors, added to image positions in sector
+	// headers, subchannel times and absolute cue times. Zero uses
+	// StandardLeadIn; NoLeadIn selects no offset.
+	LeadIn int
+
+	// BufferSectors bounds the number of sectors read but not yet written
+	// while encoding in parallel. Zero uses DefaultBufferSectorsPerWorker
+	// for each worker. See Pipeline.
+	BufferSectors int
+
+	// Strict rejects Mode 2 sectors whose subheader looks implausible (see
+	// CheckSubheader), which usually means the PMF is misaligned, and Mode 2
+	// tracks whose first sector does not look like XA data, which usually
+	// means the track's mode is wrong. It also warns about subheaders whose
+	// two copies differ, and makes an AUDIO_BYTE_ORDER directive on a disc
+	// without audio tracks an error rather than a warning.
+	Strict bool
+
+	// RepairSubheader overwrites the second copy of a Mode 2 subheader with
+	// the first when the two differ, with a warning for each sector.
+	RepairSubheader bool
+
+	// AllowTrailingPad accepts a PMF that continues past the last track, as
+	// long as the excess is all zeroes or a whole number of sectors. It is
+	// skipped with a warning instead of failing the conversion.
+	AllowTrailingPad bool
+
+	// BlankPregap writes data track pregap sectors with only the sync
+	// pattern and header, leaving the rest zero. By default they are
+	// complete sectors of zeroed user data with valid EDC and P/Q parity.
+	BlankPregap bool
+
+	// RequireByteOrder makes a missing AUDIO_BYTE_ORDER directive an error
+	// when there are audio tracks, instead of guessing the byte order.
+	RequireByteOrder bool
+
+	// PadAudio accepts a PMF whose final audio track ends part-way through
+	// its last sector, zero-filling the sector to 2352 bytes.
+	PadAudio bool
+
+	// PadMissing accepts a PMF shorter than the track table, for salvaging
+	// what there is: every sector past its end is written as zero data with
+	// valid EDC/ECC (audio: silence), with a warning of how many there were.
+	PadMissing bool
+
+	// Patches maps positions in the BIN image to bytes written over the
+	// sector's EDC (and the parity after it) once it is encoded, so that
+	// deliberately corrupted sectors of copy-protected discs are
+	// reproduced. See ReadPatchList.
+	Patches map[int][]byte
+
+	// KeepAudioMSB writes the audio of an AUDIO_MSB PMF to the image as it
+	// is, big-endian, instead of swapping it to the little-endian order BIN
+	// images normally hold. Cue sheets then declare the files holding it as
+	// MOTOROLA. It takes precedence over OutputAudioMSB.
+	KeepAudioMSB bool
+
+	// OutputAudioMSB writes audio to the image big-endian, whichever order
+	// the PMF holds it in (Disc.AudioMSB): the samples are swapped when the
+	// two differ. Cue sheets then declare the files holding it as MOTOROLA.
+	OutputAudioMSB bool
+
+	// StartSector is the position in the image from which sectors are
+	// written; the ones before it are read from the PMF but skipped. See
+	// UpdateBin.
+	StartSector int
+
+	// SubInterleaved writes each sector of the image as BinSubSector bytes:
+	// the raw sector followed by its generated subcode (see Subcode) in the
+	// raw interleaved layout of InterleaveSubcode. Cue sheets then declare
+	// the tracks with 2448-byte sector types.
+	SubInterleaved bool
+
+	// KeepPartial leaves the partly written temporary files of a failed
+	// BuildBinContext, BuildSplitBin or BuildISO in place, under their
+	// TempPath, for debugging. By default they are removed.
+	KeepPartial bool
+
+	// Scramble applies the CD scrambler (see ScrambleSector) to every data
+	// sector of the image, as some writers expect of raw input. Audio
+	// sectors are never scrambled.
+	Scramble bool
+
+	// ZeroEDCWarn is the percentage of Mode 2 Form 1 sectors with
+	// a zero EDC (all-zero data) above which a warning is given after
+	// writing. Zero uses DefaultZeroEDCWarn; a negative value disables it.
+	ZeroEDCWarn float64
+
+	// PregapWarn is the pregap length, in sectors, above which a gap in the
+	// track table draws a warning. Zero uses DefaultPregapWarn; a negative
+	// value disables the warning.
+	PregapWarn int
+
+	// MaxPregap, if positive, makes a gap in the track table longer than
+	// this many sectors an error. Explicit %PREGAP lengths are exempt from
+	// both limits.
+	MaxPregap int
+
+	// CueLeadIn writes cue sheet INDEX times as absolute disc times, with the
+	// lead-in added, as some mastering tools expect. By default they are
+	// positions in the image starting at 00:00:00, as the CUE format defines.
+	CueLeadIn bool
+
+	// CueRem lists comments written as REM lines at the top of cue sheets,
+	// such as a note of the tool and source that made the image.
+	CueRem []string
+
+	// MaxSectors is the capacity of the disc, lead-in included, that the
+	// last track must end within. Zero uses Disc80Sectors; anything above
+	// MaxDiscSectors is limited to it.
+	MaxSectors int
+
+	// Progress, if not nil, is called as the BIN image is written with the
+	// number of sectors written so far and the total for the image.
+	Progress func(done, total int)
+
+	// Stats, if not nil, receives counts gathered while writing the BIN
+	// image.
+	Stats *Stats
+
+	// Tee, if not nil, receives a copy of the BIN image as it is written,
+	// for example a Hasher.
+	Tee io.Writer
+}
+
+// Stats holds counts and findings gathered while writing a BIN image.
+type Stats struct {
+	DataSectors    int  // Mode 2 Form 1 sectors built from PMF data
+	ZeroEDCSectors int  // of those, the ones whose EDC came out zero (all-zero data)
+	AudioMSB       bool // the audio was read big-endian: as declared, or else as detected
+}
+
+// Type returns the track type as used in progress output: MODE1, MODE2 or AUDIO.
+func (t Track) Type() string {
+	return modeOf(t.Mode).name
+}
+
+// DefaultPregapWarn is the pregap length (3 seconds) above which a gap in
+// the track table is reported as a likely mistake.
+const DefaultPregapWarn = 225
+
+// DefaultZeroEDCWarn is the percentage of zero-EDC data sectors above which
+// the data is reported as likely unpopulated.
+const DefaultZeroEDCWarn = 1.0
+
+// DefaultSessionGap is the number of sectors written between two sessions
+// when a %SESSION directive does not give one.
+const DefaultSessionGap = 150
+
+const (
+	PMFSector      = 2056 // bytes per Mode 2 sector in the PMF (subheader + user data)
+	PMFForm2Sector = 2332 // bytes per Mode 2 Form 2 sector in the PMF (subheader + user data)
+	PMFMode1Sector = 2048 // bytes per Mode 1 sector in the PMF (user data only)
+	BinSector      = 2352 // bytes per raw sector in the BIN image
+)
+
+// sectorSize returns the bytes per sector of the image written with o.
+func (o Options) sectorSize() int {
+	if o.SubInterleaved {
+		return BinSubSector
+	}
+	return BinSector
+}
+
+// leadIn returns the lead-in offset in sectors selected by o.
+func (o Options) leadIn() int {
+	switch {
+	case o.LeadIn == 0:
+		return StandardLeadIn
+	case o.LeadIn < 0:
+		return 0
+	}
+	return o.LeadIn
+}
+
+// outputAudioMSB reports whether audio is written to the image with o
+// big-endian.
+func (o Options) outputAudioMSB() bool {
+	if o.KeepAudioMSB {
+		return o.AudioMSB
+	}
+	return o.OutputAudioMSB
+}
+
+// submodeForm2 is the Form bit in the submode byte of a Mode 2 subheader.
+const submodeForm2 = 0x20
+
+// Disc holds the disc-wide settings read from a .pmf.ff or cue sheet along
+// with its tracks. The package keeps no such state of its own: each parse
+// returns a Disc, and the writers take it back in Options, along with the
+// other settings of a conversion, so conversions of different discs can run
+// at the same time.
+type Disc struct {
+	// AudioMSB is set when the audio samples in the PMF are big-endian
+	// (AUDIO_MSB). The order written to the image is set separately, by
+	// Options.OutputAudioMSB.
+	AudioMSB bool
+
+	// ByteOrderDeclared records whether the layout had an AUDIO_BYTE_ORDER
+	// directive. Without one the BIN writers detect the byte order instead
+	// of using AudioMSB, and report it in Stats.
+	ByteOrderDeclared bool
+
+	// Catalog is the 13-digit media catalog number (UPC/EAN), "" if none.
+	Catalog string
+
+	// Title and Performer are the disc's CD-Text, "" if not given.
+	Title, Performer string
+}
+
+var (
+	// Info receives informational progress messages. Redirect it with
+	// Info.SetOutput (e.g. to ioutil.Discard) to change or silence them.
+	Info = log.New(os.Stdout, "", 0)
+	// Warn receives warnings about unusual but accepted input.
+	Warn = log.New(os.Stderr, "Warning: ", 0)
+)
@@ -0,0 +1,33 @@
+package pmf
+
+// scrambleTable holds the bytes of the CD scrambler sequence (ECMA-130
+// Annex B) that are XORed into bytes 12-2351 of a data sector.
+var scrambleTable [BinSector - 12]byte
+
+func init() {
+	// 15-bit LFSR with the polynomial x^15 + x + 1, preset to 1; output
+	// bits fill each byte from the least significant bit up
+	reg := uint16(1)
+	for i := range scrambleTable {
+		var b byte
+		for bit := uint(0); bit < 8; bit++ {
+			b |= byte(reg&1) << bit
+			feedback := (reg ^ reg>>1) & 1
+			reg = reg>>1 | feedback<<14
+		}
+		scrambleTable[i] = b
+	}
+}
+
+// ScrambleSector applies the CD scrambler to a 2352-byte data sector in
+// place, leaving the 12-byte sync pattern untouched. Scrambling is its own
+// inverse, so the same call descrambles a scrambled sector. It panics if
+// sector is not 2352 bytes.
+func ScrambleSector(sector []byte) {
+	if len(sector) != BinSector {
+		panic("pmf: ScrambleSector needs a 2352-byte sector")
+	}
+	for i, b := range scrambleTable {
+		sector[12+i] ^= b
+	}
+}
@@ -0,0 +1,31 @@
+package pmf
+
+import (
+	"bytes"
+	"testing"
+)
+
+// scrambleVector is the start of the CD scrambler sequence, as tabulated in
+// ECMA-130 Annex B.
+var scrambleVector = []byte{
+	0x01, 0x80, 0x00, 0x60, 0x00, 0x28, 0x00, 0x1E,
+	0x80, 0x08, 0x60, 0x06, 0xA8, 0x02, 0xFE, 0x81,
+	0x80, 0x60, 0x60, 0x28, 0x28, 0x1E, 0x9E, 0x88,
+}
+
+func TestScrambleSector(t *testing.T) {
+	var sector [BinSector]byte
+	copy(sector[:], syncPattern[:])
+	ScrambleSector(sector[:])
+	if !bytes.Equal(sector[:12], syncPattern[:]) {
+		t.Fatalf("sync pattern changed to % x", sector[:12])
+	}
+	if got := sector[12 : 12+len(scrambleVector)]; !bytes.Equal(got, scrambleVector) {
+		t.Fatalf("scrambled zeroes begin % x, want % x", got, scrambleVector)
+	}
+
+	ScrambleSector(sector[:])
+	if sector != ([BinSector]byte{0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x00}) {
+		t.Fatal("scrambling twice did not restore the sector")
+	}
+}
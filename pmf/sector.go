@@ -0,0 +1,240 @@
+package pmf
+
+import (
+	"bytes"
+	"fmt"
+)
+
+var syncPattern = [12]byte{0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x00}
+
+// SectorHeader returns the 4-byte sector header (BCD minute, second, frame
+// and mode) for the given absolute LBA. It returns an error if lba is past
+// the last MSF address, 99:59:74.
+func SectorHeader(lba, mode int) ([4]byte, error) {
+	if lba < 0 || lba >= MaxDiscSectors {
+		return [4]byte{}, newError(ErrCapacity, "sector address %d out of range 0-%d", lba, MaxDiscSectors-1)
+	}
+	return sectorHeader(lba, mode), nil
+}
+
+// sectorHeader is SectorHeader for an lba already known to be in range.
+func sectorHeader(lba, mode int) [4]byte {
+	min, sec, frame := LBAToMSF(lba)
+	return [4]byte{toBCD(min), toBCD(sec), toBCD(frame), byte(mode)}
+}
+
+// IsForm2 reports whether a Mode 2 subheader marks its sector as Form 2.
+func IsForm2(subheader []byte) bool {
+	return subheader[2]&submodeForm2 != 0
+}
+
+// Submode bits of a Mode 2 subheader that select the kind of data carried.
+const (
+	submodeVideo = 0x02
+	submodeAudio = 0x04
+	submodeData  = 0x08
+)
+
+// SubheaderCopiesMatch reports whether the two 4-byte copies of a Mode 2
+// subheader are identical, as they always are on an intact disc.
+func SubheaderCopiesMatch(subheader []byte) bool {
+	return bytes.Equal(subheader[0:4], subheader[4:8])
+}
+
+// CheckSubheader reports an error if a Mode 2 subheader looks implausible:
+// a channel number above 31, more than one of the video, audio and data
+// submode bits set, audio in a Form 1 sector, or coding information on a
+// data sector. Such subheaders are a sign of a PMF that is off by a few bytes.
+func CheckSubheader(subheader []byte) error {
+	channel, submode, coding := subheader[1], subheader[2], subheader[3]
+	if channel > 31 {
+		return fmt.Errorf("implausible subheader % X: channel %d out of range", subheader, channel)
+	}
+	kinds := 0
+	for _, bit := range []byte{submodeVideo, submodeAudio, submodeData} {
+		if submode&bit != 0 {
+			kinds++
+		}
+	}
+	if kinds > 1 {
+		return fmt.Errorf("implausible subheader % X: submode %02X mixes video, audio and data", subheader, submode)
+	}
+	if submode&submodeAudio != 0 && submode&submodeForm2 == 0 {
+		return fmt.Errorf("implausible subheader % X: audio in a Form 1 sector", subheader)
+	}
+	if submode&submodeData != 0 && coding != 0 {
+		return fmt.Errorf("implausible subheader % X: coding information %02X on a data sector", subheader, coding)
+	}
+	return nil
+}
+
+// probeXA reports an error if the subheader of the first sector of a track
+// declared Mode 2 does not look like CD-ROM XA: its two copies must match,
+// pass CheckSubheader and mark the sector as video, audio or data. Mode 1
+// or audio data read with the 2056-byte Mode 2 stride practically never
+// does, so a failure suggests the track's mode in the .pmf.ff is wrong.
+func probeXA(subheader []byte) error {
+	if !SubheaderCopiesMatch(subheader) {
+		return fmt.Errorf("subheader copies differ (% X)", subheader)
+	}
+	if err := CheckSubheader(subheader); err != nil {
+		return err
+	}
+	if subheader[2]&(submodeVideo|submodeAudio|submodeData) == 0 {
+		return fmt.Errorf("subheader % X marks neither video, audio nor data", subheader)
+	}
+	return nil
+}
+
+// EncodeSector assembles the complete 2352-byte sector at the absolute
+// address lba of a track of the given .pmf.ff mode from its PMF payload:
+// 2048 bytes of user data for Mode 1, an 8-byte subheader and 2048 (Form 1)
+// or 2324 (Form 2) bytes of user data for Mode 2, and 2352 bytes of
+// little-endian samples for audio, which are returned as they are. Mode 1
+// and audio sectors take no subheader. Unlike the mode-specific encoders, it
+// returns an error for field sizes that do not fit the mode.
+func EncodeSector(lba, mode int, subheader, data []byte) ([BinSector]byte, error) {
+	if lba < 0 || lba >= MaxDiscSectors {
+		return [BinSector]byte{}, newError(ErrCapacity, "sector address %d out of range 0-%d", lba, MaxDiscSectors-1)
+	}
+	if _, ok := lookupMode(mode); !ok {
+		return [BinSector]byte{}, newError(ErrInvalidMode, "unsupported mode %d; supported modes are %s", mode, supportedModes())
+	}
+	if mode != 2 && len(subheader) != 0 {
+		return [BinSector]byte{}, fmt.Errorf("mode %d sectors have no subheader, got %d bytes", mode, len(subheader))
+	}
+
+	header := sectorHeader(lba, mode)
+	switch mode {
+	case 4:
+		if len(data) != BinSector {
+			return [BinSector]byte{}, fmt.Errorf("audio sectors need %d bytes of samples, got %d", BinSector, len(data))
+		}
+		var sector [BinSector]byte
+		copy(sector[:], data)
+		return sector, nil
+	case 1:
+		if len(data) != PMFMode1Sector {
+			return [BinSector]byte{}, fmt.Errorf("Mode 1 sectors need %d bytes of user data, got %d", PMFMode1Sector, len(data))
+		}
+		return EncodeMode1Sector(header[:], data), nil
+	}
+	if len(subheader) != 8 {
+		return [BinSector]byte{}, fmt.Errorf("Mode 2 sectors need an 8-byte subheader, got %d bytes", len(subheader))
+	}
+	form, want := 1, PMFSector-8
+	if IsForm2(subheader) {
+		form, want = 2, PMFForm2Sector-8
+	}
+	if len(data) != want {
+		return [BinSector]byte{}, fmt.Errorf("Mode 2 Form %d sectors need %d bytes of user data, got %d", form, want, len(data))
+	}
+	return EncodeMode2Sector(header[:], subheader, data), nil
+}
+
+// EncodeMode2Sector assembles a Mode 2 sector as Form 1 or Form 2 depending on
+// the Form bit in the subheader's submode byte. data must be 2048 bytes for
+// Form 1 and 2324 bytes for Form 2.
+func EncodeMode2Sector(header, subheader, data []byte) [BinSector]byte {
+	if IsForm2(subheader) {
+		return EncodeMode2Form2Sector(header, subheader, data)
+	}
+	return EncodeMode2Form1Sector(header, subheader, data)
+}
+
+// EncodeMode2Form1Sector assembles a complete 2352-byte CD-ROM XA Mode 2 Form 1
+// sector from its 4-byte header, 8-byte subheader and 2048 bytes of user data.
+// The sync pattern, EDC and P/Q parity are generated.
+func EncodeMode2Form1Sector(header, subheader, data []byte) [BinSector]byte {
+	if len(header) != 4 || len(subheader) != 8 || len(data) != 2048 {
+		panic(fmt.Sprintf("wrong field sizes: need 4/8/2048 bytes, got %d/%d/%d", len(header), len(subheader), len(data)))
+	}
+
+	var sector [BinSector]byte
+	// 12-byte sync
+	copy(sector[0:12], syncPattern[:])
+	// 4-byte header with accurate MSF
+	copy(sector[12:16], header)
+	// 8-byte subheader
+	copy(sector[16:24], subheader)
+	// 2048 bytes of data
+	copy(sector[24:2072], data)
+	// 4-byte calculated EDC over subheader and data, not sync or header
+	edc := ComputeEDC(sector[16:2072])
+	copy(sector[2072:2076], edc[:])
+	// 172-byte P-parity
+	mustParity(PParityInto(sector[2076:2248], sector[12:2076]))
+	// 104-byte Q-parity
+	mustParity(QParityInto(sector[2248:2352], sector[12:2248]))
+	return sector
+}
+
+// EncodeMode2Form2Sector assembles a complete 2352-byte CD-ROM XA Mode 2 Form 2
+// sector from its 4-byte header, 8-byte subheader and 2324 bytes of user data.
+// Form 2 sectors carry no P/Q parity; the EDC over bytes 16-2347 is generated.
+func EncodeMode2Form2Sector(header, subheader, data []byte) [BinSector]byte {
+	if len(header) != 4 || len(subheader) != 8 || len(data) != 2324 {
+		panic(fmt.Sprintf("wrong field sizes: need 4/8/2324 bytes, got %d/%d/%d", len(header), len(subheader), len(data)))
+	}
+
+	var sector [BinSector]byte
+	// 12-byte sync
+	copy(sector[0:12], syncPattern[:])
+	// 4-byte header with accurate MSF
+	copy(sector[12:16], header)
+	// 8-byte subheader
+	copy(sector[16:24], subheader)
+	// 2324 bytes of data
+	copy(sector[24:2348], data)
+	// 4-byte calculated EDC over subheader and data, not sync or header
+	edc := ComputeEDC(sector[16:2348])
+	copy(sector[2348:2352], edc[:])
+	return sector
+}
+
+// EncodeMode1Sector assembles a complete 2352-byte CD-ROM Mode 1 sector from its
+// 4-byte header and 2048 bytes of user data. Unlike Mode 2, the EDC covers the
+// sync and header as well, and the header takes part in the P/Q parity.
+func EncodeMode1Sector(header, data []byte) [BinSector]byte {
+	if len(header) != 4 || len(data) != 2048 {
+		panic(fmt.Sprintf("wrong field sizes: need 4/2048 bytes, got %d/%d", len(header), len(data)))
+	}
+
+	var sector [BinSector]byte
+	// 12-byte sync
+	copy(sector[0:12], syncPattern[:])
+	// 4-byte header with accurate MSF
+	copy(sector[12:16], header)
+	// 2048 bytes of data
+	copy(sector[16:2064], data)
+	// 4-byte calculated EDC over sync, header and data
+	edc := ComputeEDC(sector[0:2064])
+	copy(sector[2064:2068], edc[:])
+	// 8 intermediate bytes remain zero
+	// 172-byte P-parity, header included
+	mustParity(pParity(sector[2076:2248], sector[12:2076], false))
+	// 104-byte Q-parity, header included
+	mustParity(qParity(sector[2248:2352], sector[12:2248], false))
+	return sector
+}
+
+// looksLikeMode2 reports whether a 2352-byte audio sector read from the PMF
+// is really the start of two Mode 2 sectors: a plausible, duplicated
+// subheader at the start and another one PMF sector later. Real audio,
+// silence included, practically never matches.
+func looksLikeMode2(raw []byte) bool {
+	next := PMFSector
+	if IsForm2(raw[:8]) {
+		next = PMFForm2Sector
+	}
+	for _, off := range []int{0, next} {
+		sh := raw[off : off+8]
+		if !bytes.Equal(sh[0:4], sh[4:8]) || sh[2]&(submodeVideo|submodeAudio|submodeData) == 0 {
+			return false
+		}
+		if CheckSubheader(sh) != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package pmf
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEncodeSectorLengths(t *testing.T) {
+	form1 := []byte{0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x08, 0x00}
+	form2 := []byte{0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x20, 0x00}
+	tests := []struct {
+		name      string
+		lba, mode int
+		subheader []byte
+		data      int  // length of the user data
+		ok        bool // whether the sector is encoded
+	}{
+		{"Mode 1", 150, 1, nil, 2048, true},
+		{"Mode 1 short", 150, 1, nil, 2047, false},
+		{"Mode 1 with subheader", 150, 1, form1, 2048, false},
+		{"Form 1", 150, 2, form1, 2048, true},
+		{"Form 1 with Form 2 data", 150, 2, form1, 2324, false},
+		{"Form 2", 150, 2, form2, 2324, true},
+		{"Form 2 with Form 1 data", 150, 2, form2, 2048, false},
+		{"Mode 2 short subheader", 150, 2, form1[:4], 2048, false},
+		{"Mode 2 without subheader", 150, 2, nil, 2056, false},
+		{"audio", 150, 4, nil, BinSector, true},
+		{"audio long", 150, 4, nil, BinSector + 1, false},
+		{"audio with subheader", 150, 4, form1, BinSector, false},
+	}
+	for _, tt := range tests {
+		_, err := EncodeSector(tt.lba, tt.mode, tt.subheader, make([]byte, tt.data))
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestEncodeSectorRange(t *testing.T) {
+	for _, lba := range []int{-1, MaxDiscSectors} {
+		if _, err := EncodeSector(lba, 1, nil, make([]byte, 2048)); !errors.Is(err, ErrCapacity) {
+			t.Errorf("address %d: error %v, want %v", lba, err, ErrCapacity)
+		}
+	}
+	if _, err := EncodeSector(MaxDiscSectors-1, 1, nil, make([]byte, 2048)); err != nil {
+		t.Errorf("address %d: %v", MaxDiscSectors-1, err)
+	}
+	if _, err := EncodeSector(150, 3, nil, make([]byte, 2048)); !errors.Is(err, ErrInvalidMode) {
+		t.Errorf("mode 3: error %v, want %v", err, ErrInvalidMode)
+	}
+}
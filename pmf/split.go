@@ -0,0 +1,221 @@
+package pmf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TrackFileName returns the name of track num's file in a split image of
+// count tracks, following the usual "stem (Track N).bin" convention: track
+// numbers are padded to two digits on discs of ten or more tracks, and a
+// single-track disc keeps the plain "stem.bin".
+func TrackFileName(stem string, num, count int) string {
+	switch {
+	case count == 1:
+		return stem + ".bin"
+	case count >= 10:
+		return fmt.Sprintf("%s (Track %02d).bin", stem, num)
+	}
+	return fmt.Sprintf("%s (Track %d).bin", stem, num)
+}
+
+// GroupFileNames returns the names of the files of an image of tracks split
+// in two, for BuildSplitBin and WriteSplitCue: "stem (Data).bin" for the
+// data tracks and "stem (Audio).bin" for the audio tracks, or just
+// "stem.bin" if there is only one kind. Each kind must form one run of
+// consecutive tracks.
+func GroupFileNames(stem string, tracks []Track) ([]string, error) {
+	names := make([]string, len(tracks))
+	kinds := 0
+	for i, t := range tracks {
+		if i == 0 || (t.Mode == 4) != (tracks[i-1].Mode == 4) {
+			kinds++
+		}
+		if kinds > 2 {
+			kind := "data"
+			if t.Mode == 4 {
+				kind = "audio"
+			}
+			return nil, fmt.Errorf("track %d starts a second run of %s tracks; grouping by mode needs all data tracks together and all audio tracks together, so use -split instead", t.Num, kind)
+		}
+		names[i] = stem + " (Data).bin"
+		if t.Mode == 4 {
+			names[i] = stem + " (Audio).bin"
+		}
+	}
+	if kinds == 1 {
+		for i := range names {
+			names[i] = stem + ".bin"
+		}
+	}
+	return names, nil
+}
+
+// splitWriter distributes the BIN image among one writer per track, each
+// receiving the track's sectors including its pregap. Consecutive tracks may
+// share a writer.
+type splitWriter struct {
+	files []io.Writer
+	sizes []int64 // bytes per track in the image
+	cur   int     // track currently being written
+	n     int64   // bytes written to the current track
+}
+
+func (s *splitWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if s.cur >= len(s.files) {
+			return written, fmt.Errorf("image is larger than its tracks")
+		}
+		n := s.sizes[s.cur] - s.n
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		m, err := s.files[s.cur].Write(p[:n])
+		written += m
+		s.n += int64(m)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if s.n == s.sizes[s.cur] {
+			s.cur++
+			s.n = 0
+		}
+	}
+	return written, nil
+}
+
+// BuildSplitBin writes the image of tracks as one BIN file per track, at the
+// corresponding entry of outPaths. Each file holds the track's pregap (unless
+// logical) followed by its data, as in a single image cut at the track
+// boundaries. Consecutive tracks with the same path share one file, as with
+// GroupFileNames. A file named .wav gets a WAV header before its sectors,
+// which must all be audio, so a cue sheet can declare it WAVE. As with
+// BuildBinContext, each file is written under its TempPath, and the files are
+// renamed together once the whole image is complete (see finishTemps).
+func BuildSplitBin(ctx context.Context, pmf io.Reader, tracks []Track, outPaths []string, opts Options) (err error) {
+	if len(outPaths) != len(tracks) {
+		return fmt.Errorf("%d file names for %d tracks", len(outPaths), len(tracks))
+	}
+
+	var files []*os.File
+	var paths []string
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		for _, f := range files {
+			closeErr := f.Close()
+			if err == nil && closeErr != nil {
+				err = ioError(closeErr, "Close failed: %v", closeErr)
+			}
+		}
+		err = finishTemps(paths, err, opts.KeepPartial)
+		if err == nil {
+			for _, path := range paths {
+				Info.Printf("Wrote BIN image: %s", path)
+			}
+		}
+	}()
+
+	sw := &splitWriter{}
+	for i, t := range tracks {
+		if i == 0 || outPaths[i] != outPaths[i-1] {
+			f, err := os.Create(TempPath(outPaths[i]))
+			if err != nil {
+				return ioError(err, "Failed to create %s: %v", TempPath(outPaths[i]), err)
+			}
+			files = append(files, f)
+			paths = append(paths, outPaths[i])
+			if strings.EqualFold(filepath.Ext(outPaths[i]), ".wav") {
+				if opts.SubInterleaved {
+					return fmt.Errorf("%s cannot hold subchannel data", outPaths[i])
+				}
+				if opts.outputAudioMSB() {
+					return fmt.Errorf("%s cannot hold big-endian audio", outPaths[i])
+				}
+				size := 0
+				for j := i; j < len(tracks) && outPaths[j] == outPaths[i]; j++ {
+					if tracks[j].Mode != 4 {
+						return fmt.Errorf("track %d is not audio but goes to %s", tracks[j].Num, outPaths[j])
+					}
+					size += tracks[j].ImageSectors() * BinSector
+				}
+				if err := writeWAVHeader(f, size); err != nil {
+					return ioError(err, "Failed to write %s: %v", TempPath(outPaths[i]), err)
+				}
+			}
+		}
+		sw.files = append(sw.files, files[len(files)-1])
+		sw.sizes = append(sw.sizes, int64(t.ImageSectors())*int64(opts.sectorSize()))
+	}
+
+	if err := WriteBin(ctx, pmf, tracks, sw, opts); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := f.Sync(); err != nil {
+			return ioError(err, "Sync failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// finishTemps renames the temporary files of paths into place if err is nil,
+// as finishTemp does for one file, but all or none of them: the files they
+// replace are moved aside first, and if a rename fails, those already done
+// are undone, leaving paths as they were. The temporary files are then
+// removed, unless keep is set.
+func finishTemps(paths []string, err error, keep bool) error {
+	var moved, placed []string
+	if err == nil {
+		for _, path := range paths {
+			if _, statErr := os.Stat(path); statErr != nil {
+				continue
+			}
+			if renameErr := os.Rename(path, oldPath(path)); renameErr != nil {
+				err = ioError(renameErr, "Failed to rename %s: %v", path, renameErr)
+				break
+			}
+			moved = append(moved, path)
+		}
+	}
+	if err == nil {
+		for _, path := range paths {
+			if renameErr := os.Rename(TempPath(path), path); renameErr != nil {
+				err = ioError(renameErr, "Failed to rename %s: %v", TempPath(path), renameErr)
+				break
+			}
+			placed = append(placed, path)
+		}
+	}
+
+	if err != nil {
+		for _, path := range placed {
+			os.Rename(path, TempPath(path))
+		}
+		for _, path := range moved {
+			os.Rename(oldPath(path), path)
+		}
+		if !keep {
+			for _, path := range paths {
+				os.Remove(TempPath(path))
+			}
+		}
+		return err
+	}
+	for _, path := range moved {
+		os.Remove(oldPath(path))
+	}
+	return nil
+}
+
+// oldPath returns the name a file at path is moved to while finishTemps
+// replaces it.
+func oldPath(path string) string {
+	return path + ".old"
+}
@@ -0,0 +1,63 @@
+package pmf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFinishTempsUndo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmf-split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Track 1 replaces an older file; track 2's temporary file is missing,
+	// so its rename fails after track 1's
+	one, two := filepath.Join(dir, "a (Track 1).bin"), filepath.Join(dir, "a (Track 2).bin")
+	for path, data := range map[string]string{one: "old", TempPath(one): "new"} {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := finishTemps([]string{one, two}, nil, false); err == nil {
+		t.Fatal("finishTemps succeeded without a temporary file for track 2")
+	}
+
+	if data, err := ioutil.ReadFile(one); err != nil || string(data) != "old" {
+		t.Errorf("track 1 holds %q (%v), want the old file back", data, err)
+	}
+	for _, path := range []string{TempPath(one), oldPath(one), two} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind", filepath.Base(path))
+		}
+	}
+}
+
+func TestFinishTemps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmf-split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	one, two := filepath.Join(dir, "a (Track 1).bin"), filepath.Join(dir, "a (Track 2).bin")
+	for path, data := range map[string]string{one: "old", TempPath(one): "new 1", TempPath(two): "new 2"} {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := finishTemps([]string{one, two}, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{one: "new 1", two: "new 2"} {
+		if data, err := ioutil.ReadFile(path); err != nil || string(data) != want {
+			t.Errorf("%s holds %q (%v), want %q", filepath.Base(path), data, err, want)
+		}
+	}
+	if _, err := os.Stat(oldPath(one)); !os.IsNotExist(err) {
+		t.Errorf("%s left behind", filepath.Base(oldPath(one)))
+	}
+}
@@ -0,0 +1,240 @@
+package pmf
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// SubSector is the number of subchannel bytes per sector in a .sub file.
+const SubSector = 96
+
+// BinSubSector is the size of a sector in a BIN image with interleaved
+// subchannel data (see Options.SubInterleaved): the raw sector followed by
+// its subcode.
+const BinSubSector = BinSector + SubSector
+
+// Subcode returns the 96 bytes of P-W subchannel data for the sector at
+// position pos (relative to the start of the image) of track t, in the
+// non-interleaved layout used by .sub files: 12 bytes per channel, P first.
+//
+// P is set throughout the pregap. Q normally carries mode-1 position data:
+// control and ADR, track number, index (00 in the pregap, 01 otherwise), the
+// relative time (counting down to INDEX 01 in the pregap), the absolute time
+// including the lead-in of opts, and a CRC-16 over the first 10 bytes.
+// When opts.Catalog is not "", every 100th sector carries that media catalog
+// number in a mode-2 Q frame instead; likewise the track's ISRC in a mode-3
+// frame, offset by 50 sectors. R-W are zero. It returns an error if the track
+// number or either time cannot be stored in BCD.
+func Subcode(t Track, pos int, opts Options) ([SubSector]byte, error) {
+	leadIn := opts.leadIn()
+	if t.Num < 0 || t.Num > MaxTracks {
+		return [SubSector]byte{}, newError(ErrTrackNumber, "track number %d out of range 0-%d", t.Num, MaxTracks)
+	}
+	if pos < 0 || pos+leadIn >= MaxDiscSectors || t.Start < 0 || t.Start >= MaxDiscSectors {
+		return [SubSector]byte{}, newError(ErrCapacity, "position %d of track %d (starting at %d) out of range 0-%d", pos, t.Num, t.Start, MaxDiscSectors-leadIn-1)
+	}
+	return subcode(t, pos, opts.Catalog, leadIn), nil
+}
+
+// subcode is Subcode for a track and position already known to be in range.
+func subcode(t Track, pos int, catalog string, leadIn int) [SubSector]byte {
+	var sub [SubSector]byte
+	inPregap := pos < t.Start
+
+	if inPregap {
+		for i := 0; i < 12; i++ {
+			sub[i] = 0xFF
+		}
+	}
+
+	q := sub[12:24]
+	control := byte(0x0) // 2-channel audio
+	if t.Mode != 4 {
+		control = 0x4 // data track
+	}
+	_, _, aframe := LBAToMSF(pos + leadIn)
+
+	switch {
+	case catalog != "" && pos%100 == 0:
+		q[0] = control<<4 | 0x2 // ADR 2: media catalog number
+		packDigits(q[1:8], catalog)
+		q[9] = toBCD(aframe)
+	case t.ISRC != "" && !inPregap && pos%100 == 50:
+		q[0] = control<<4 | 0x3 // ADR 3: ISRC
+		packISRC(q[1:9], t.ISRC)
+		q[9] = toBCD(aframe)
+	default:
+		q[0] = control<<4 | 0x1 // ADR 1: current position
+		q[1] = toBCD(t.Num)
+		rel := pos - t.Start
+		if inPregap {
+			q[2] = toBCD(0)
+			rel = t.Start - pos
+		} else {
+			q[2] = toBCD(1)
+		}
+		min, sec, frame := LBAToMSF(rel)
+		q[3], q[4], q[5] = toBCD(min), toBCD(sec), toBCD(frame)
+		q[6] = 0
+		min, sec, frame = LBAToMSF(pos + leadIn)
+		q[7], q[8], q[9] = toBCD(min), toBCD(sec), toBCD(frame)
+	}
+	crc := subQCRC(q[:10])
+	q[10], q[11] = byte(crc>>8), byte(crc)
+	return sub
+}
+
+// packDigits stores a string of decimal digits into dst as packed BCD, two
+// digits per byte, high nibble first.
+func packDigits(dst []byte, digits string) {
+	for i := 0; i < len(digits); i++ {
+		d := digits[i] - '0'
+		if i%2 == 0 {
+			dst[i/2] |= d << 4
+		} else {
+			dst[i/2] |= d
+		}
+	}
+}
+
+// packISRC encodes an ISRC into the 8 data bytes of a mode-3 Q frame: the
+// five country and owner characters in 6 bits each, followed by the year and
+// serial number as packed BCD.
+func packISRC(dst []byte, isrc string) {
+	var bits uint64
+	for i := 0; i < 5; i++ {
+		c := isrc[i]
+		var v uint64
+		if c >= '0' && c <= '9' {
+			v = uint64(c - '0')
+		} else {
+			v = uint64(c-'A') + 0x11
+		}
+		bits = bits<<6 | v
+	}
+	bits <<= 2 // 30 bits of characters, left-aligned in 32
+	dst[0], dst[1], dst[2], dst[3] = byte(bits>>24), byte(bits>>16), byte(bits>>8), byte(bits)
+	packDigits(dst[4:8], isrc[5:])
+}
+
+// subQCRC computes the Q subchannel CRC-16 (polynomial 0x1021, initial value
+// 0). The result is stored inverted.
+func subQCRC(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return ^crc
+}
+
+// WriteSub writes a .sub file with generated P and Q subchannel data for
+// every sector of the image described by tracks, including pregaps unless they
+// are logical, with the catalog number and lead-in of opts.
+func WriteSub(tracks []Track, subPath string, opts Options) (err error) {
+	out, err := os.Create(TempPath(subPath))
+	if err != nil {
+		return fmt.Errorf("Failed to create %s: %v", subPath, err)
+	}
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		closeErr := out.Close()
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("Close failed: %v", closeErr)
+		}
+		err = finishTemp(subPath, err, false)
+		if err == nil {
+			Info.Printf("Wrote subchannel: %s", subPath)
+		}
+	}()
+	bw := bufio.NewWriter(out)
+
+	subs := newSubcodeStream(tracks, opts)
+	for _, t := range tracks {
+		for s := 0; s < t.ImageSectors(); s++ {
+			sub := subs.next()
+			bw.Write(sub[:])
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("Flush failed: %v", err)
+	}
+
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("Sync failed: %v", err)
+	}
+	return nil
+}
+
+// subcodeStream yields the subcode of each sector of an image in turn, in
+// the order the sectors are written: nothing for the gap between sessions,
+// then Subcode for the pregap (unless logical) and data of each track.
+type subcodeStream struct {
+	tracks  []Track
+	catalog string
+	leadIn  int
+	i       int // current track
+	gap     int // session gap sectors of track i still to come
+	pos     int // next position in track i
+}
+
+func newSubcodeStream(tracks []Track, opts Options) *subcodeStream {
+	s := &subcodeStream{tracks: tracks, catalog: opts.Catalog, leadIn: opts.leadIn()}
+	s.start(0)
+	return s
+}
+
+// start moves the stream to the session gap of track i.
+func (s *subcodeStream) start(i int) {
+	s.i = i
+	if i >= len(s.tracks) {
+		return
+	}
+	t := s.tracks[i]
+	s.gap = t.SessionGap
+	s.pos = t.Start - t.Pregap
+	if t.LogicalPregap {
+		s.pos = t.Start
+	}
+}
+
+// next returns the subcode of the next sector, or zeroes past the last
+// track.
+func (s *subcodeStream) next() [SubSector]byte {
+	for s.i < len(s.tracks) && s.gap == 0 && s.pos > s.tracks[s.i].End {
+		s.start(s.i + 1)
+	}
+	if s.i >= len(s.tracks) || s.gap > 0 {
+		if s.gap > 0 {
+			s.gap--
+		}
+		return [SubSector]byte{}
+	}
+	// The track layout keeps every position within an MSF address
+	sub := subcode(s.tracks[s.i], s.pos, s.catalog, s.leadIn)
+	s.pos++
+	return sub
+}
+
+// InterleaveSubcode converts 96 bytes of subcode from the non-interleaved
+// layout of Subcode and .sub files (12 bytes per channel, P first) to the raw
+// layout read from drives and stored after each sector of a 2448-byte image:
+// 96 symbols, each holding one bit of every channel, P in the high bit.
+func InterleaveSubcode(sub [SubSector]byte) [SubSector]byte {
+	var raw [SubSector]byte
+	for ch := 0; ch < 8; ch++ {
+		for k := 0; k < SubSector; k++ {
+			bit := sub[ch*12+k/8] >> uint(7-k%8) & 1
+			raw[k] |= bit << uint(7-ch)
+		}
+	}
+	return raw
+}
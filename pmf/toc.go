@@ -0,0 +1,89 @@
+package pmf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WriteTOC writes a cdrdao TOC file for tracks that references the BIN image
+// binName, with the catalog number of disc. Pregap sectors are part of each
+// track's data range and marked with START, matching their physical presence
+// in the image; logical pregaps are declared with PREGAP instead. Audio in
+// the BIN is little-endian, so audio tracks are flagged SWAP; WriteTOC cannot
+// describe an image written with big-endian audio (Options.OutputAudioMSB or
+// KeepAudioMSB).
+func WriteTOC(tracks []Track, tocPath, binName string, disc Disc) (err error) {
+	if len(tracks) > 0 && tracks[len(tracks)-1].Session > 1 {
+		return fmt.Errorf("a TOC file cannot describe more than one session")
+	}
+
+	out, err := os.Create(TempPath(tocPath))
+	if err != nil {
+		return fmt.Errorf("Failed to write toc: %v", err)
+	}
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		closeErr := out.Close()
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("Close failed: %v", closeErr)
+		}
+		err = finishTemp(tocPath, err, false)
+		if err == nil {
+			Info.Printf("Wrote TOC file: %s", tocPath)
+		}
+	}()
+
+	discType := "CD_DA"
+	for _, t := range tracks {
+		switch {
+		case t.Mode == 2:
+			discType = "CD_ROM_XA"
+		case t.Mode == 1 && discType == "CD_DA":
+			discType = "CD_ROM"
+		}
+	}
+	if disc.Catalog != "" {
+		fmt.Fprintf(out, "CATALOG \"%s\"\n", disc.Catalog)
+	}
+	fmt.Fprintf(out, "%s\n", discType)
+
+	name := filepath.Base(binName)
+	starts := imageStarts(tracks)
+	for i, t := range tracks {
+		first := starts[i]
+		if !t.LogicalPregap {
+			first -= t.Pregap
+		}
+		offset := int64(first) * BinSector
+		length := LBAToMSFFormatted(starts[i] + t.End - t.Start - first + 1)
+
+		fmt.Fprintf(out, "\n// Track %d\n", t.Num)
+		fmt.Fprintf(out, "TRACK %s\n", tocTrackMode(t.Mode))
+		if t.ISRC != "" {
+			fmt.Fprintf(out, "ISRC \"%s\"\n", t.ISRC)
+		}
+		if t.Pregap > 0 && t.LogicalPregap {
+			// cdrdao requires PREGAP ahead of the track's data
+			fmt.Fprintf(out, "PREGAP %s\n", LBAToMSFFormatted(t.Pregap))
+		}
+		if t.Mode == 4 {
+			fmt.Fprintf(out, "FILE \"%s\" SWAP #%d 0 %s\n", name, offset, length)
+		} else {
+			fmt.Fprintf(out, "DATAFILE \"%s\" #%d %s\n", name, offset, length)
+		}
+		if t.Pregap > 0 && !t.LogicalPregap {
+			fmt.Fprintf(out, "START %s\n", LBAToMSFFormatted(t.Pregap))
+		}
+	}
+
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("Sync failed: %v", err)
+	}
+	return nil
+}
+
+// tocTrackMode returns the cdrdao track mode for a .pmf.ff mode code.
+func tocTrackMode(mode int) string {
+	return modeOf(mode).tocType
+}
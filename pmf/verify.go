@@ -0,0 +1,286 @@
+package pmf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SectorCheck is the result of recomputing the EDC and P/Q parity of a raw sector.
+type SectorCheck struct {
+	Checked bool // the sector is Mode 1 or Mode 2 Form 1 and was checked
+	EDC     bool // stored EDC matches the computed one
+	PParity bool // stored P-parity matches the computed one
+	QParity bool // stored Q-parity matches the computed one
+}
+
+// OK reports whether every checked field matched.
+func (c SectorCheck) OK() bool {
+	return !c.Checked || (c.EDC && c.PParity && c.QParity)
+}
+
+// CheckSector recomputes the EDC and P/Q parity of a 2352-byte sector and
+// compares them with the stored values. Sectors without a sync pattern (audio)
+// and Mode 2 Form 2 sectors carry no parity and are reported as not checked.
+func CheckSector(sector []byte) SectorCheck {
+	var c SectorCheck
+	if len(sector) != BinSector || !bytes.Equal(sector[0:12], syncPattern[:]) {
+		return c
+	}
+
+	var edc [4]byte
+	var zeroHeader bool
+	var edcPos int
+	switch sector[15] {
+	case 1:
+		edc = ComputeEDC(sector[0:2064])
+		edcPos = 2064
+	case 2:
+		if IsForm2(sector[16:24]) {
+			return c
+		}
+		edc = ComputeEDC(sector[16:2072])
+		edcPos = 2072
+		zeroHeader = true
+	default:
+		return c
+	}
+
+	var p [172]byte
+	var q [104]byte
+	if pParity(p[:], sector[12:2076], zeroHeader) != nil || qParity(q[:], sector[12:2248], zeroHeader) != nil {
+		return c
+	}
+
+	c.Checked = true
+	c.EDC = bytes.Equal(edc[:], sector[edcPos:edcPos+4])
+	c.PParity = bytes.Equal(p[:], sector[2076:2248])
+	c.QParity = bytes.Equal(q[:], sector[2248:2352])
+	return c
+}
+
+// checkSectorSize reports an ErrSubchannelImage error if the image in f,
+// opened from binPath, is a whole number of BinSubSector sectors but not of
+// BinSector ones: an image written with Options.SubInterleaved, which would
+// otherwise be read as misaligned 2352-byte sectors.
+func checkSectorSize(f *os.File, binPath string) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", binPath, err)
+	}
+	if size := fi.Size(); size%BinSector != 0 && size%BinSubSector == 0 {
+		return newError(ErrSubchannelImage, "%s holds %d-byte sectors, which are not supported", binPath, BinSubSector)
+	}
+	return nil
+}
+
+// VerifyBin runs CheckSector over every sector of the BIN image at binPath.
+// report, if not nil, is called for each sector that fails its check, with the
+// sector's position in the image. It returns the number of sectors checked
+// and the number that failed.
+func VerifyBin(binPath string, report func(lba int, c SectorCheck)) (checked, failed int, err error) {
+	f, err := os.Open(binPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open %s: %v", binPath, err)
+	}
+	defer f.Close()
+	if err := checkSectorSize(f, binPath); err != nil {
+		return 0, 0, err
+	}
+
+	br := bufio.NewReader(f)
+	var sector [BinSector]byte
+	for lba := 0; ; lba++ {
+		_, err := io.ReadFull(br, sector[:])
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			return checked, failed, fmt.Errorf("%s ends with a partial sector", binPath)
+		}
+		if err != nil {
+			return checked, failed, fmt.Errorf("error reading %s: %v", binPath, err)
+		}
+
+		c := CheckSector(sector[:])
+		if !c.Checked {
+			continue
+		}
+		checked++
+		if !c.OK() {
+			failed++
+			if report != nil {
+				report(lba, c)
+			}
+		}
+	}
+	return checked, failed, nil
+}
+
+// FixSector recomputes the EDC and P/Q parity of a raw Mode 1 or Mode 2 Form
+// 1 sector in place, keeping its sync, header, subheader and user data. mode
+// is the mode of the sector's track (1 or 2), or 0 to take it from the
+// sector header. Sectors without a sync pattern, audio and Mode 2 Form 2
+// sectors are left alone. It reports whether the sector was checked and
+// whether any of its bytes changed.
+func FixSector(sector []byte, mode int) (checked, changed bool) {
+	if len(sector) != BinSector || !bytes.Equal(sector[0:12], syncPattern[:]) {
+		return false, false
+	}
+	if mode == 0 {
+		mode = int(sector[15])
+	}
+
+	var fixed [BinSector]byte
+	switch mode {
+	case 1:
+		fixed = EncodeMode1Sector(sector[12:16], sector[16:2064])
+	case 2:
+		if IsForm2(sector[16:24]) {
+			return false, false
+		}
+		fixed = EncodeMode2Form1Sector(sector[12:16], sector[16:24], sector[24:2072])
+	default:
+		return false, false
+	}
+	if bytes.Equal(fixed[:], sector) {
+		return true, false
+	}
+	copy(sector, fixed[:])
+	return true, true
+}
+
+// FixBin runs FixSector over every sector of the BIN image at binPath and
+// writes the corrected sectors back in place. tracks, as read by ParseCue
+// from the image's cue sheet, give the mode of each sector; audio tracks are
+// skipped. Without them, each sector's mode is taken from its header. It
+// returns the number of sectors checked and the number corrected.
+func FixBin(binPath string, tracks []Track) (checked, fixed int, err error) {
+	f, err := os.OpenFile(binPath, os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open %s: %v", binPath, err)
+	}
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		closeErr := f.Close()
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("Close failed: %v", closeErr)
+		}
+	}()
+	if err := checkSectorSize(f, binPath); err != nil {
+		return 0, 0, err
+	}
+
+	br := bufio.NewReader(f)
+	var sector [BinSector]byte
+	t := 0
+	for lba := 0; ; lba++ {
+		_, err := io.ReadFull(br, sector[:])
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			return checked, fixed, fmt.Errorf("%s ends with a partial sector", binPath)
+		}
+		if err != nil {
+			return checked, fixed, fmt.Errorf("error reading %s: %v", binPath, err)
+		}
+
+		mode := 0
+		if tracks != nil {
+			for t < len(tracks)-1 && lba > tracks[t].End {
+				t++
+			}
+			mode = tracks[t].Mode
+			if mode == 4 {
+				continue
+			}
+		}
+		ok, changed := FixSector(sector[:], mode)
+		if ok {
+			checked++
+		}
+		if !changed {
+			continue
+		}
+		// The reads go through br; WriteAt leaves the file offset alone
+		if _, err := f.WriteAt(sector[:], int64(lba)*BinSector); err != nil {
+			return checked, fixed, fmt.Errorf("error writing %s: %v", binPath, err)
+		}
+		fixed++
+	}
+
+	if err := f.Sync(); err != nil {
+		return checked, fixed, fmt.Errorf("Sync failed: %v", err)
+	}
+	return checked, fixed, nil
+}
+
+// submodeNames names the bits of a Mode 2 submode byte, lowest first.
+var submodeNames = []string{"EOR", "Video", "Audio", "Data", "Trigger", "Form 2", "Real-time", "EOF"}
+
+// SectorInfo is the decoded content of a raw sector, as returned by
+// InspectSector.
+type SectorInfo struct {
+	Sync      bool     // the sector starts with the sync pattern
+	Header    []byte   // the 4-byte header: BCD minute, second and frame, and the mode
+	Address   int      // the header's address as an image position (lead-in removed), -1 if not BCD
+	Mode      int      // the header's mode byte
+	Subheader []byte   // the 8-byte Mode 2 subheader, nil for other modes
+	Submode   []string // names of the submode bits set in the first subheader copy
+	Form2     bool     // Mode 2 Form 2, whose EDC is optional and which has no parity
+
+	// StoredEDC and ComputedEDC are the EDC in the sector and the one
+	// computed over its data, nil for a sector of an unknown mode.
+	StoredEDC, ComputedEDC []byte
+
+	Check SectorCheck // the EDC and P/Q parity check of CheckSector
+}
+
+// InspectSector decodes the fields of a raw 2352-byte sector and checks its
+// EDC and P/Q parity, for troubleshooting a single sector, taking the header
+// address as having the lead-in of opts. Audio sectors have no sync pattern
+// and decode to nothing but that.
+func InspectSector(sector []byte, opts Options) SectorInfo {
+	var info SectorInfo
+	if len(sector) != BinSector || !bytes.Equal(sector[0:12], syncPattern[:]) {
+		return info
+	}
+	info.Sync = true
+	info.Header = sector[12:16]
+	info.Mode = int(sector[15])
+	info.Address = -1
+	min, okMin := fromBCD(sector[12])
+	sec, okSec := fromBCD(sector[13])
+	frame, okFrame := fromBCD(sector[14])
+	if okMin && okSec && okFrame {
+		info.Address = MSFToLBA(min, sec, frame) - opts.leadIn()
+	}
+
+	var edcStart, edcPos int
+	switch info.Mode {
+	case 1:
+		edcStart, edcPos = 0, 2064
+	case 2:
+		info.Subheader = sector[16:24]
+		for bit, name := range submodeNames {
+			if sector[18]&(1<<uint(bit)) != 0 {
+				info.Submode = append(info.Submode, name)
+			}
+		}
+		info.Form2 = IsForm2(info.Subheader)
+		edcStart, edcPos = 16, 2072
+		if info.Form2 {
+			edcPos = 2348
+		}
+	default:
+		return info
+	}
+	edc := ComputeEDC(sector[edcStart:edcPos])
+	info.StoredEDC = sector[edcPos : edcPos+4]
+	info.ComputedEDC = edc[:]
+	info.Check = CheckSector(sector)
+	return info
+}
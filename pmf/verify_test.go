@@ -0,0 +1,39 @@
+package pmf
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSubchannelImageRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmf-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binPath := filepath.Join(dir, "disc.bin")
+	if err := ioutil.WriteFile(binPath, make([]byte, 10*BinSubSector), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := VerifyBin(binPath, nil); !errors.Is(err, ErrSubchannelImage) {
+		t.Errorf("VerifyBin: error %v, want %v", err, ErrSubchannelImage)
+	}
+	if _, _, err := FixBin(binPath, nil); !errors.Is(err, ErrSubchannelImage) {
+		t.Errorf("FixBin: error %v, want %v", err, ErrSubchannelImage)
+	}
+
+	for _, trackType := range []string{"MODE1/2448", "MODE2/2448", "CDG"} {
+		cuePath := filepath.Join(dir, "disc.cue")
+		cue := "FILE \"disc.bin\" BINARY\n  TRACK 01 " + trackType + "\n    INDEX 01 00:00:00\n"
+		if err := ioutil.WriteFile(cuePath, []byte(cue), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := ParseCue(cuePath); !errors.Is(err, ErrSubchannelImage) {
+			t.Errorf("%s: error %v, want %v", trackType, err, ErrSubchannelImage)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package pmf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// WAVHeaderSize is the size of the RIFF header before the samples of the
+// WAV files written for audio tracks.
+const WAVHeaderSize = 44
+
+// writeWAVHeader writes the 44-byte RIFF header of a WAV file holding
+// dataLen bytes of CD audio: 44.1 kHz, 16-bit, stereo PCM.
+func writeWAVHeader(w io.Writer, dataLen int) error {
+	if dataLen%4 != 0 {
+		return fmt.Errorf("%d bytes of audio are not a whole number of 4-byte stereo frames", dataLen)
+	}
+	const (
+		channels   = 2
+		sampleRate = 44100
+		bits       = 16
+		blockAlign = channels * bits / 8
+	)
+	var h [WAVHeaderSize]byte
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(36+dataLen))
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16) // fmt chunk size
+	binary.LittleEndian.PutUint16(h[20:], 1)  // PCM
+	binary.LittleEndian.PutUint16(h[22:], channels)
+	binary.LittleEndian.PutUint32(h[24:], sampleRate)
+	binary.LittleEndian.PutUint32(h[28:], sampleRate*blockAlign)
+	binary.LittleEndian.PutUint16(h[32:], blockAlign)
+	binary.LittleEndian.PutUint16(h[34:], bits)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(dataLen))
+	_, err := w.Write(h[:])
+	return err
+}
+
+// writeWAV writes samples, little-endian 16-bit stereo, to a WAV file at
+// wavPath, by way of its TempPath like the images.
+func writeWAV(wavPath string, samples []byte) (err error) {
+	out, err := os.Create(TempPath(wavPath))
+	if err != nil {
+		return ioError(err, "Failed to create %s: %v", TempPath(wavPath), err)
+	}
+	defer func() {
+		// Always attempt to close, even if an earlier error occurred
+		closeErr := out.Close()
+		if err == nil && closeErr != nil {
+			err = ioError(closeErr, "Close failed: %v", closeErr)
+		}
+		err = finishTemp(wavPath, err, false)
+	}()
+
+	bw := bufio.NewWriter(out)
+	if err := writeWAVHeader(bw, len(samples)); err != nil {
+		return ioError(err, "Failed to write %s: %v", TempPath(wavPath), err)
+	}
+	if _, err := bw.Write(samples); err != nil {
+		return ioError(err, "Failed to write %s: %v", TempPath(wavPath), err)
+	}
+	if err := bw.Flush(); err != nil {
+		return ioError(err, "Flush failed: %v", err)
+	}
+	if err := out.Sync(); err != nil {
+		return ioError(err, "Sync failed: %v", err)
+	}
+	return nil
+}
@@ -1,615 +1,2072 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/andkrau/pmf2bin/pmf"
 )
 
-type Track struct {
-	Num    int
-	Mode   int
-	Start  int
-	End    int
-	Pregap int // number of sectors in pregap (INDEX 00)
+// version identifies the build in cue sheet remarks. Release builds set it
+// with -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// info receives informational output; -quiet discards it.
+var info = log.New(os.Stdout, "", 0)
+
+// warnings collects the warnings of the run, which pmf.Warn is pointed at,
+// to be listed together when it ends.
+var warnings = &warningLog{}
+
+// interactive is set when a user is at the console: the console title is
+// set, a file picker may be shown and the program pauses before exiting.
+// -batch, PMF2BIN_NONINTERACTIVE or a redirected stdin turn it off.
+var interactive bool
+
+// options holds the per-file settings taken from the command line.
+type options struct {
+	ctx context.Context // cancelled on Ctrl+C
+
+	output        string  // output path without extension, or "-" for stdout
+	stdin         bool    // read the PMF from standard input
+	pmfPath       string  // the .pmf file, if named with -pmf
+	ffPath        string  // the .pmf.ff file, if named with -ff
+	cuePath       string  // -o -: where to write the cue sheet
+	check         bool    // validate the layout only, without writing output
+	previews      bool    // write WAV previews in both byte orders instead of converting
+	jobs          int     // number of parallel sector encoders
+	sub           bool    // also write a .sub subchannel file
+	subInterleave bool    // write 2448-byte sectors with the subcode after each
+	toc           bool    // write a cdrdao .toc instead of a .cue
+	gdi           bool    // write one .bin per track and a .gdi instead of a .cue
+	split         bool    // write one .bin per track
+	groupByMode   bool    // write the data tracks and the audio tracks to two .bin files
+	iso           bool    // write a flat 2048-byte-sector .iso instead
+	leadIn        int     // sector header address offset, in sectors
+	cueLeadIn     bool    // write absolute cue INDEX times, lead-in included
+	oversize      bool    // allow layouts up to 99:59:74 instead of 80 minutes
+	logicalPregap bool    // leave pregaps out of the bin and declare them with PREGAP
+	strict        bool    // reject implausible Mode 2 subheaders
+	repairSubhdr  bool    // make the second subheader copy match the first
+	trailingPad   bool    // tolerate padding after the last track
+	blankPregap   bool    // write data pregaps as sync and header only
+	scramble      bool    // scramble data sectors as on the disc
+	requireOrder  bool    // fail on audio without an AUDIO_BYTE_ORDER directive
+	padAudio      bool    // zero-fill a short final audio sector
+	padMissing    bool    // zero-fill the sectors missing from a truncated PMF
+	keepMSB       bool    // leave AUDIO_MSB audio big-endian in the bin
+	outMSB        bool    // write audio to the bin big-endian, whatever the PMF holds
+	appendFrom    int     // rewrite the existing bin from this sector on (-1: write it anew)
+	keepPartial   bool    // leave the outputs of a failed conversion in place
+	wav           bool    // write audio tracks as .wav files
+	progress      bool    // show a percentage on stderr while writing
+	pregapWarn    int     // warn about pregaps longer than this many sectors
+	maxPregap     int     // fail on pregaps longer than this many sectors
+	zeroEDCWarn   float64 // warn when more data sectors than this percentage have a zero EDC
+	ccd           bool    // also write a CloneCD .ccd control file
+	hash          bool    // print CRC32/MD5/SHA-1 of the image and its tracks
+	chd           bool    // compress the result into a .chd with chdman
+	chdOnly       bool    // remove the .bin and cue sheet after creating the .chd
+	json          bool    // print the layout as JSON instead of converting
+	remMetadata   bool    // note the version, date, source and byte order in the cue
+	dryRun        bool    // list the files that would be written, without writing them
+	roundTrip     bool    // check that the bin would extract back to the PMF, without writing it
+	maxMemory     int64   // read PMFs of up to this many bytes into memory (0: stream every PMF)
+
+	patches map[int][]byte // -sbi: bytes written over the EDC of protected sectors, by LBA
+	report  *runReport     // -report: the conversions so far
+
+	bin2pmf  bool // convert a BIN/CUE back into a .pmf/.pmf.ff premaster
+	audioMSB bool // bin2pmf: store audio big-endian (AUDIO_MSB)
 }
 
-const (
-	pmfSector = 2056
-	binSector = 2352
-)
+// layoutJSON is the -json representation of a parsed premaster.
+type layoutJSON struct {
+	PMF          string      `json:"pmf"`
+	FF           string      `json:"ff"`
+	AudioMSB     bool        `json:"audioMSB"`
+	ExpectedSize int         `json:"expectedSize"`
+	PMFSize      int         `json:"pmfSize"`
+	Tracks       []trackJSON `json:"tracks"`
+	TOC          pmf.TOC     `json:"toc"`
+}
 
-var (
-	audioMSB bool
-	edcLUT [256]uint32
-	gfLog [256]byte
-	gfPow [509]byte
-)
+type trackJSON struct {
+	pmf.Track
+	Type     string `json:"type"`
+	Index00  string `json:"index00,omitempty"`
+	StartMSF string `json:"startMSF"`
+	EndMSF   string `json:"endMSF"`
+}
 
-func init() {
-	// Create EDC Lookup table
-	const polyEDC uint32 = 0xD8018001 // reflected polynomial of 0x04C11DB7
-	for i := 0; i < 256; i++ {
-		r := uint32(i)
-		for j := 0; j < 8; j++ {
-			if r&1 != 0 {
-				r = (r >> 1) ^ polyEDC
-			} else {
-				r >>= 1
-			}
+// runReport collects the -report summaries of the conversions of a run.
+type runReport struct {
+	path        string
+	Conversions []conversionJSON `json:"conversions"`
+}
+
+type conversionJSON struct {
+	Source         string            `json:"source"`
+	PMFBytes       int64             `json:"pmfBytes"`
+	Outputs        []outputJSON      `json:"outputs"`
+	Tracks         []trackReportJSON `json:"tracks"`
+	TOC            pmf.TOC           `json:"toc"`
+	DataSectors    int               `json:"dataSectors"`
+	ZeroEDCSectors int               `json:"zeroEDCSectors"`
+	Warnings       []string          `json:"warnings,omitempty"`
+	Seconds        float64           `json:"seconds"`
+}
+
+type outputJSON struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+type trackReportJSON struct {
+	pmf.Track
+	Type    string `json:"type"`
+	Sectors int    `json:"sectors"` // in the image, pregap and session gap included
+	Bytes   int64  `json:"bytes"`
+}
+
+// usageError reports invalid command-line usage, which exits with status 2.
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+func main() {
+	err := run(os.Args[1:])
+	warnings.summarize(os.Stderr)
+	if err != nil {
+		log.Println(err)
+	}
+	if interactive {
+		pauseOnExit()
+	}
+	if _, ok := err.(usageError); ok {
+		os.Exit(2)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// run processes the command line and converts every requested premaster.
+func run(args []string) error {
+	var opts options
+	var continueOnError, quiet, verbose, batch, selfTest bool
+	var verifyBin, fixBin, inspectArg, listCue, patchList, reportPath, outOrder, maxMemory string
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flags.StringVar(&opts.output, "o", "", "output `path` without extension (default: next to the input)")
+	flags.StringVar(&opts.output, "output", "", "same as -o `path`")
+	flags.BoolVar(&opts.stdin, "stdin", false, "read the PMF from standard input (requires -ff)")
+	flags.StringVar(&opts.pmfPath, "pmf", "", "the .pmf `file` to convert, for premasters named differently from their .pmf.ff")
+	flags.StringVar(&opts.ffPath, "ff", "", "the .pmf.ff `file` holding the track table, or a .cue sheet to take the layout from (required with -stdin)")
+	flags.StringVar(&opts.cuePath, "cue", "", "with -o -, write the cue sheet to `file`")
+	flags.BoolVar(&opts.bin2pmf, "bin2pmf", false, "convert a .cue/.bin image back into a .pmf/.pmf.ff premaster")
+	flags.BoolVar(&opts.audioMSB, "audio-msb", false, "with -bin2pmf, store audio samples big-endian (AUDIO_MSB)")
+	flags.BoolVar(&selfTest, "selftest", false, "check the EDC and ECC tables against known values and exit")
+	flags.StringVar(&verifyBin, "verify-bin", "", "recompute EDC/ECC of every Mode 1 and Mode 2 Form 1 sector in `file.bin` and report mismatches")
+	flags.StringVar(&inspectArg, "inspect", "", "print the header, subheader, EDC and P/Q parity check of one sector, given as `file.bin:sector` or file.bin:@byteoffset")
+	flags.StringVar(&fixBin, "fix-ecc", "", "recompute EDC/ECC of every Mode 1 and Mode 2 Form 1 sector in `file.bin` and rewrite the ones that differ, in place")
+	flags.StringVar(&listCue, "list", "", "print the table of contents of an existing `file.cue` and its BIN image")
+	flags.BoolVar(&opts.json, "json", false, "print the parsed track layout as JSON without writing output")
+	flags.IntVar(&opts.jobs, "j", 0, "number of parallel sector encoders (default: number of CPUs)")
+	flags.BoolVar(&opts.toc, "toc", false, "write a cdrdao .toc file instead of a .cue sheet")
+	flags.BoolVar(&opts.wav, "wav", false, "write each audio track to its own .wav file, declared WAVE in the cue sheet, as with -split (or -group-by-mode)")
+	flags.BoolVar(&opts.gdi, "gdi", false, "write one .bin per track and a .gdi track list (Dreamcast GD-ROM style) instead of a .cue sheet")
+	flags.BoolVar(&opts.iso, "iso", false, "write the user data of the data tracks as a flat .iso (2048 bytes per sector) instead of a .bin and cue sheet")
+	flags.StringVar(&reportPath, "report", "", "after each conversion, write a JSON summary of all conversions so far (tracks, sizes, EDC counts, time) to `report.json`")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "list the files that would be written, their sizes and the free space at the destination, without writing anything")
+	flags.BoolVar(&opts.groupByMode, "group-by-mode", false, "write the data tracks to \"file (Data).bin\" and the audio tracks to \"file (Audio).bin\", with a FILE for each in the cue sheet")
+	flags.BoolVar(&opts.remMetadata, "rem-metadata", true, "note the pmf2bin version, date, source PMF and audio byte order in REM lines of the cue sheet")
+	flags.BoolVar(&opts.split, "split", false, "write one .bin file per track, named \"file (Track N).bin\", with a FILE per track in the cue sheet")
+	flags.IntVar(&opts.leadIn, "leadin", pmf.StandardLeadIn, "offset of sector header addresses in `sectors` (the standard is 150)")
+	flags.BoolVar(&opts.cueLeadIn, "cue-leadin", false, "write cue INDEX times as absolute disc times, with the -leadin offset added")
+	flags.BoolVar(&opts.logicalPregap, "logical-pregap", false, "leave pregaps out of the .bin and declare them with PREGAP in the cue sheet")
+	flags.BoolVar(&opts.strict, "strict", false, "stop at the first Mode 2 sector with an implausible subheader (misaligned PMF) or a Mode 2 track that does not start like XA data (wrong mode), and warn about subheaders whose two copies differ")
+	flags.BoolVar(&opts.repairSubhdr, "repair-subheader", false, "when the two copies of a Mode 2 subheader differ, overwrite the second with the first")
+	flags.BoolVar(&opts.trailingPad, "allow-trailing-pad", false, "skip zero or whole-sector padding after the last track instead of failing")
+	flags.BoolVar(&opts.blankPregap, "blank-pregap", false, "write data track pregaps as sync and header only, without EDC/ECC")
+	flags.BoolVar(&opts.scramble, "scramble", false, "apply the CD scrambler to data sectors, for writers that take scrambled raw images")
+	flags.BoolVar(&opts.requireOrder, "require-byte-order", false, "fail when audio tracks have no AUDIO_BYTE_ORDER directive instead of detecting the order")
+	flags.StringVar(&patchList, "sbi", "", "write the bytes listed in `patchlist.txt` (lines of \"LBA: hex bytes\") over the EDC of those sectors, to reproduce copy protection")
+	flags.IntVar(&opts.appendFrom, "append-from", -1, "rewrite the existing .bin only from image position `sector` on, keeping the sectors before it")
+	flags.BoolVar(&opts.keepPartial, "keep-partial", false, "leave the partly written files of a failed conversion in place, for debugging")
+	flags.BoolVar(&opts.padMissing, "pad-missing", false, "zero-fill the sectors missing from a truncated PMF instead of failing, for salvage")
+	flags.BoolVar(&opts.keepMSB, "keep-audio-msb", false, "write the audio of an AUDIO_MSB premaster to the bin big-endian, as it is, and declare it MOTOROLA in the cue sheet")
+	flags.StringVar(&outOrder, "out-audio-order", "AUDIO_LSB", "byte `order` of the audio written to the bin, AUDIO_LSB or AUDIO_MSB (declared MOTOROLA in the cue sheet), whatever the PMF holds")
+	flags.BoolVar(&opts.padAudio, "pad-audio", false, "zero-pad a final audio track that ends part-way through a sector")
+	flags.IntVar(&opts.pregapWarn, "pregap-warn", pmf.DefaultPregapWarn, "warn about pregaps longer than `sectors` (-1 to disable)")
+	flags.IntVar(&opts.maxPregap, "max-pregap", 0, "fail on pregaps longer than `sectors` (0: no limit)")
+	flags.Float64Var(&opts.zeroEDCWarn, "zero-edc-warn", pmf.DefaultZeroEDCWarn, "warn when more than this `percent` of data sectors have a zero EDC (-1 to disable)")
+	flags.StringVar(&maxMemory, "max-memory", "1G", "read PMFs of up to `size` bytes (with a K, M or G suffix) into memory before converting them, and stream larger ones (0 streams every PMF)")
+	flags.BoolVar(&opts.progress, "progress", false, "show the percentage written on stderr (terminals only)")
+	flags.BoolVar(&opts.oversize, "oversize", false, "allow images longer than an 80-minute disc, up to 99:59:74")
+	flags.BoolVar(&opts.hash, "hash", false, "print the size, CRC32, MD5 and SHA-1 of the .bin and of each track as datfile entries")
+	flags.BoolVar(&opts.ccd, "ccd", false, "also write a CloneCD .ccd control file")
+	flags.BoolVar(&opts.chd, "chd", false, "also create a .chd image with chdman (must be on PATH)")
+	flags.BoolVar(&opts.chdOnly, "chd-only", false, "like -chd, but delete the .bin and cue sheet afterwards")
+	flags.BoolVar(&opts.sub, "sub", false, "also write a .sub file with generated P/Q subchannel data")
+	flags.BoolVar(&opts.subInterleave, "sub-interleaved", false, "write 2448-byte sectors to the .bin, each followed by its generated subchannel data")
+	flags.BoolVar(&opts.previews, "endian-swap-all", false, "write the first seconds of the first audio track as WAV in both byte orders, to hear which is right, without converting")
+	flags.BoolVar(&opts.check, "check", false, "validate the .pmf.ff against the .pmf and print the track table without writing output")
+	flags.BoolVar(&opts.roundTrip, "roundtrip-check", false, "encode every sector in memory, extract its PMF data again as -bin2pmf would and compare it with the input, without writing output")
+	flags.BoolVar(&continueOnError, "continue-on-error", false, "keep converting the remaining files after a failure")
+	flags.BoolVar(&batch, "batch", false, "never prompt, pause or show a file picker (also PMF2BIN_NONINTERACTIVE=1)")
+	flags.BoolVar(&batch, "noninteractive", false, "same as -batch")
+	flags.BoolVar(&quiet, "quiet", false, "only print warnings and errors")
+	flags.BoolVar(&verbose, "verbose", false, "print each warning as it occurs, not only in the summary at the end")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [options] <file.pmf.ff>...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
 		}
-		edcLUT[i] = r
+		return usageError{err.Error()}
+	}
+
+	// Listed at the end, where they do not scroll away with the progress
+	warnings.verbose = verbose
+	pmf.Warn.SetPrefix("")
+	pmf.Warn.SetOutput(warnings)
+
+	interactive = !batch && os.Getenv("PMF2BIN_NONINTERACTIVE") == "" && isTerminal(os.Stdin)
+	if interactive {
+		setConsoleTitle("PMF2BIN")
+	}
+
+	if opts.output == "-" {
+		// Keep standard output for the image
+		info.SetOutput(os.Stderr)
+		pmf.Info.SetOutput(os.Stderr)
+	}
+	if quiet || opts.json {
+		info.SetOutput(ioutil.Discard)
+		pmf.Info.SetOutput(ioutil.Discard)
+	}
+
+	if opts.leadIn < 0 {
+		return usageError{"-leadin must not be negative"}
+	}
+	memLimit, err := parseSize(maxMemory)
+	if err != nil {
+		return usageError{fmt.Sprintf("invalid -max-memory %q: expected a size such as 512M", maxMemory)}
+	}
+	opts.maxMemory = memLimit
+	if opts.leadIn != pmf.StandardLeadIn {
+		pmf.Warn.Printf("using a nonstandard lead-in of %d sectors; sector headers will not match a standard disc", opts.leadIn)
 	}
 
-	// Creates the exponentiation (gfPow) and logarithm (gfLog) tables
-	// for the Galois Field GF(2^8), essential for Reed-Solomon arithmetic.
-	// The tables are generated using the irreducible polynomial: x^8 + x^4 + x^3 + x^2 + 1,
-	// which corresponds to the reduction value 0x11D.
-	// The process generates successive powers of the primitive element α (alpha).
-	//
-	// When b exceeds 8 bits, b ^= 0x11d reduces it by the irreducible polynomial.
-	// The second loop extends gfPow to 509 elements to avoid modulo 255
-	// operations during multiplication (optimization: gfPow[a+b] instead of gfPow[(a+b)%255]).
-	var b uint16 = 1
-	for i := 0; i < 255; i++ {
-		gfPow[i] = byte(b)
-		gfLog[b] = byte(i)
-		b <<= 1
-		if b&0x100 != 0 {
-			b ^= 0x11d
+	// A broken table would silently corrupt every image written
+	if err := pmf.SelfTest(); err != nil {
+		return fmt.Errorf("Self-test failed: %v", err)
+	}
+	if selfTest {
+		info.Println("Self-test passed")
+		return nil
+	}
+
+	if opts.chdOnly {
+		opts.chd = true
+	}
+	if opts.output == "-" && (opts.sub || opts.ccd || opts.chd || opts.bin2pmf) {
+		return usageError{"-o - cannot be combined with -sub, -ccd, -chd or -bin2pmf"}
+	}
+	if opts.cuePath != "" && opts.output != "-" {
+		return usageError{"-cue is only used with -o -"}
+	}
+	if opts.stdin && opts.ffPath == "" {
+		return usageError{"-stdin requires -ff"}
+	}
+	if opts.stdin && opts.pmfPath != "" {
+		return usageError{"-stdin cannot be combined with -pmf"}
+	}
+	if opts.bin2pmf && (opts.pmfPath != "" || opts.ffPath != "") {
+		return usageError{"-bin2pmf cannot be combined with -pmf or -ff"}
+	}
+	if opts.previews && (opts.stdin || opts.output == "-" || opts.bin2pmf) {
+		return usageError{"-endian-swap-all cannot be combined with -stdin, -o - or -bin2pmf"}
+	}
+	if opts.keepMSB && (opts.toc || opts.ccd || opts.bin2pmf) {
+		return usageError{"-keep-audio-msb cannot be combined with -toc, -ccd or -bin2pmf"}
+	}
+	switch strings.ToUpper(outOrder) {
+	case "AUDIO_LSB":
+	case "AUDIO_MSB":
+		opts.outMSB = true
+	default:
+		return usageError{fmt.Sprintf("unknown -out-audio-order %q: expected AUDIO_LSB or AUDIO_MSB", outOrder)}
+	}
+	if opts.outMSB && (opts.keepMSB || opts.toc || opts.ccd || opts.wav || opts.bin2pmf) {
+		return usageError{"-out-audio-order AUDIO_MSB cannot be combined with -keep-audio-msb, -toc, -ccd, -wav or -bin2pmf"}
+	}
+	if opts.dryRun && (opts.stdin || opts.output == "-" || opts.bin2pmf) {
+		return usageError{"-dry-run cannot be combined with -stdin, -o - or -bin2pmf"}
+	}
+	if opts.roundTrip && (opts.stdin || opts.output == "-" || opts.bin2pmf) {
+		return usageError{"-roundtrip-check cannot be combined with -stdin, -o - or -bin2pmf"}
+	}
+	if opts.iso && (opts.output == "-" || opts.split || opts.toc || opts.sub || opts.ccd || opts.chd || opts.hash) {
+		return usageError{"-iso cannot be combined with -o -, -split, -toc, -sub, -ccd, -chd or -hash"}
+	}
+	if opts.gdi {
+		if opts.output == "-" || opts.toc || opts.ccd || opts.iso || opts.groupByMode || opts.appendFrom >= 0 {
+			return usageError{"-gdi cannot be combined with -o -, -toc, -ccd, -iso, -group-by-mode or -append-from"}
 		}
+		// A .gdi lists one file per track
+		opts.split = true
 	}
-	for i := 255; i < 509; i++ {
-		gfPow[i] = gfPow[i-255]
+	if opts.wav {
+		if opts.output == "-" || opts.toc || opts.ccd || opts.iso || opts.gdi || opts.keepMSB || opts.appendFrom >= 0 || opts.hash {
+			return usageError{"-wav cannot be combined with -o -, -toc, -ccd, -iso, -gdi, -keep-audio-msb, -append-from or -hash"}
+		}
+		if !opts.groupByMode {
+			opts.split = true
+		}
+	}
+	if opts.split && (opts.output == "-" || opts.toc || opts.ccd) {
+		return usageError{"-split cannot be combined with -o -, -toc or -ccd"}
+	}
+	if opts.groupByMode && (opts.split || opts.iso || opts.output == "-" || opts.toc || opts.ccd) {
+		return usageError{"-group-by-mode cannot be combined with -split, -iso, -o -, -toc or -ccd"}
+	}
+	if opts.appendFrom >= 0 && (opts.output == "-" || opts.split || opts.groupByMode || opts.iso || opts.hash || opts.dryRun || opts.bin2pmf) {
+		return usageError{"-append-from cannot be combined with -o -, -split, -group-by-mode, -iso, -hash, -dry-run or -bin2pmf"}
+	}
+	if opts.subInterleave && (opts.toc || opts.ccd || opts.gdi || opts.iso || opts.wav || opts.hash) {
+		return usageError{"-sub-interleaved cannot be combined with -toc, -ccd, -gdi, -iso, -wav or -hash"}
+	}
+	if opts.ccd && opts.logicalPregap {
+		return usageError{"-ccd cannot be combined with -logical-pregap"}
+	}
+	if reportPath != "" {
+		if opts.bin2pmf {
+			return usageError{"-report cannot be combined with -bin2pmf"}
+		}
+		opts.report = &runReport{path: reportPath}
+	}
+	if patchList != "" {
+		if opts.bin2pmf || opts.iso {
+			return usageError{"-sbi cannot be combined with -bin2pmf or -iso"}
+		}
+		patches, err := pmf.ReadPatchList(patchList)
+		if err != nil {
+			return err
+		}
+		opts.patches = patches
+	}
+	if opts.chd {
+		if _, err := exec.LookPath("chdman"); err != nil {
+			return fmt.Errorf("-chd needs chdman from the MAME tools, but it was not found on PATH")
+		}
 	}
 
-	setConsoleTitle("PMF2BIN")
-}
+	// Ctrl+C cancels the running conversion, which removes its partial .bin
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	opts.ctx = ctx
 
-func main() {
-	var path string
-	defer pauseOnExit()
+	if verifyBin != "" {
+		return verify(verifyBin)
+	}
+	if fixBin != "" {
+		return fixECC(fixBin)
+	}
+	if inspectArg != "" {
+		return inspect(inspectArg, &opts)
+	}
+	if listCue != "" {
+		return list(listCue)
+	}
 
-	if len(os.Args) < 2 {
-		if runtime.GOOS == "windows" {
+	if opts.stdin {
+		if flags.NArg() > 0 {
+			return usageError{"-stdin takes no input files"}
+		}
+		if err := convertStdin(&opts); err != nil {
+			return err
+		}
+		info.Println("\nDone!")
+		return nil
+	}
+
+	if opts.pmfPath != "" || opts.ffPath != "" {
+		if flags.NArg() > 0 {
+			return usageError{"-pmf and -ff take the place of an input file"}
+		}
+		pmfPath, ffPath := opts.pmfPath, opts.ffPath
+		var err error
+		switch {
+		case pmfPath == "" && strings.EqualFold(filepath.Ext(ffPath), ".cue"):
+			// A layout cue sheet goes with the PMF of the same name
+			pmfPath = findPMF(strings.TrimSuffix(ffPath, filepath.Ext(ffPath)) + ".pmf")
+			if !fileExists(pmfPath) {
+				err = fmt.Errorf("%s has no matching %s (use -pmf for other names)", ffPath, pmfPath)
+			}
+		case pmfPath == "":
+			pmfPath, _, err = premasterPaths(ffPath)
+		case ffPath == "":
+			_, ffPath, err = premasterPaths(pmfPath)
+		}
+		if err == nil {
+			err = convertPremaster(pmfPath, ffPath, &opts)
+		}
+		if err != nil {
+			return err
+		}
+		info.Println("\nDone!")
+		return nil
+	}
+
+	var paths []string
+	if flags.NArg() < 1 {
+		if runtime.GOOS != "windows" || !interactive {
+			flags.Usage()
+			return usageError{"no input file given"}
+		}
 		cmd := exec.Command("powershell", "-Command",
 			`Add-Type -AssemblyName System.Windows.Forms;
 			$f = New-Object System.Windows.Forms.OpenFileDialog;
-			$f.Filter = "Premaster files (*.pmf,*.pmf.ff)|*.pmf;*.pmf.ff";
+			$f.Filter = "Premaster files (*.pmf,*.ff,*.pmf.gz,*.pmf.zip)|*.pmf;*.ff;*.pmf.gz;*.pmf.zip";
 			if ($f.ShowDialog() -eq 'OK') { Write-Output $f.FileName }`)
 		out, err := cmd.Output()
 		if err != nil {
-			log.Println("No file selected or error: ", err)
-			return
+			return fmt.Errorf("No file selected or error: %v", err)
 		}
-		path = strings.TrimSpace(string(out))
+		path := strings.TrimSpace(string(out))
 		if path == "" {
-			log.Println("No file selected!")
-			return
+			return fmt.Errorf("No file selected!")
+		}
+		paths = append(paths, path)
+	} else {
+		paths = expandArgs(flags.Args())
+	}
+
+	if opts.output != "" && len(paths) > 1 {
+		return usageError{"-o can only be used with a single input file"}
+	}
+
+	if len(paths) == 1 {
+		if err := convert(paths[0], &opts); err != nil {
+			return err
+		}
+		info.Println("\nDone!")
+		return nil
+	}
+
+	var failures []string
+	processed := 0
+	for i, path := range paths {
+		info.Printf("\n[%d/%d] %s", i+1, len(paths), path)
+		warnings.begin(path)
+		processed++
+		if err := convert(path, &opts); err != nil {
+			log.Println(err)
+			failures = append(failures, path)
+			if !continueOnError || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+
+	info.Printf("\nConverted %d of %d files", processed-len(failures), len(paths))
+	for _, path := range failures {
+		info.Printf("  FAILED: %s", path)
+	}
+	if processed < len(paths) {
+		info.Printf("  Skipped %d remaining files (use -continue-on-error to keep going)\n", len(paths)-processed)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d files failed", len(failures), len(paths))
+	}
+
+	info.Println("\nDone!")
+	return nil
+}
+
+// expandArgs expands glob patterns in the arguments, which Windows shells
+// leave to the program. Arguments that match nothing are kept as given so
+// they fail with a normal "file not found" error.
+func expandArgs(args []string) []string {
+	var paths []string
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
+		if err != nil || len(matches) == 0 {
+			paths = append(paths, arg)
+			continue
+		}
+		paths = append(paths, matches...)
+	}
+	return paths
+}
+
+// convert turns one premaster (given as its .pmf or .pmf.ff path) into a BIN/CUE pair.
+func convert(path string, opts *options) error {
+	if opts.bin2pmf {
+		return convertToPMF(path, opts)
+	}
+
+	pmfPath, ffPath, err := premasterPaths(path)
+	if err != nil {
+		return err
+	}
+	return convertPremaster(pmfPath, ffPath, opts)
+}
+
+// premasterPaths returns the .pmf and .pmf.ff paths of the premaster named by
+// path, which may be either file or their common stem. The track table may
+// also be named with just .ff (game.pmf and game.ff), or held in a layout
+// header in the PMF, which is used unless path names a .ff; ffPath is then
+// the PMF itself. It fails, naming the file, if path is neither or its
+// partner does not exist.
+func premasterPaths(path string) (pmfPath, ffPath string, err error) {
+	lower := strings.ToLower(path)
+	var ffCandidates []string
+	switch {
+	case strings.HasSuffix(lower, ".pmf.ff"):
+		ffPath = path
+		pmfPath = findPMF(path[:len(path)-len(".ff")])
+	case strings.HasSuffix(lower, ".ff"):
+		ffPath = path
+		pmfPath = findPMF(path[:len(path)-len(".ff")] + matchCase(path, ".pmf"))
+	case strings.HasSuffix(lower, ".pmf.gz"), strings.HasSuffix(lower, ".pmf.zip"):
+		pmfPath = path
+		ffCandidates = ffPaths(strings.TrimSuffix(path, filepath.Ext(path)))
+	case strings.HasSuffix(lower, ".pmf"):
+		pmfPath = path
+		ffCandidates = ffPaths(path)
+	case filepath.Ext(path) == "" && fileExists(findPMF(path+".pmf")):
+		pmfPath = findPMF(path + ".pmf")
+		ffCandidates = ffPaths(path + ".pmf")
+	default:
+		return "", "", fmt.Errorf("%s is not a .pmf or .pmf.ff file", path)
+	}
+	if ffCandidates != nil {
+		ffPath = ffCandidates[0]
+		for _, p := range ffCandidates {
+			if fileExists(p) {
+				ffPath = p
+				break
+			}
+		}
+	}
+
+	if (path == pmfPath || path == ffPath) && !fileExists(path) {
+		return "", "", fmt.Errorf("%s not found", path)
+	}
+	if !fileExists(pmfPath) {
+		return "", "", fmt.Errorf("%s has no matching %s (use -pmf and -ff for other names)", path, pmfPath)
+	}
+	if ffCandidates != nil {
+		// A track table in the PMF's own header comes first
+		_, embedded, err := embeddedLayout(pmfPath)
+		if err != nil {
+			return "", "", fmt.Errorf("Failed to read %s: %v", pmfPath, err)
+		}
+		if embedded {
+			if fileExists(ffPath) {
+				pmf.Warn.Printf("%s has a layout header; ignoring %s", pmfPath, ffPath)
+			}
+			return pmfPath, pmfPath, nil
+		}
+	}
+	if !fileExists(ffPath) {
+		missing := ffPath
+		if ffCandidates != nil {
+			missing = strings.Join(ffCandidates, " or ")
+		}
+		return "", "", fmt.Errorf("%s has no matching %s (use -pmf and -ff for other names)", path, missing)
+	}
+	return pmfPath, ffPath, nil
+}
+
+// ffPaths returns the names the track table of the PMF at pmfPath (without
+// any .gz or .zip) may have, in order of preference: game.pmf.ff, then
+// game.ff. The extension follows the case of the .pmf.
+func ffPaths(pmfPath string) []string {
+	stem := pmfPath[:len(pmfPath)-len(".pmf")]
+	ext := matchCase(pmfPath, ".ff")
+	return []string{pmfPath + ext, stem + ext}
+}
+
+// matchCase returns ext in upper case if path ends in an upper-case letter,
+// so a partner of GAME.PMF is looked for as GAME.PMF.FF.
+func matchCase(path, ext string) string {
+	if c := path[len(path)-1]; c >= 'A' && c <= 'Z' {
+		return strings.ToUpper(ext)
+	}
+	return ext
+}
+
+// findPMF returns the PMF at path, or its compressed form path.gz or
+// path.zip if only that exists.
+func findPMF(path string) string {
+	for _, p := range []string{path, path + ".gz", path + ".zip"} {
+		if fileExists(p) {
+			return p
+		}
+	}
+	return path
+}
+
+// openPMF opens the PMF at path, decompressing a .gz file or a .zip archive
+// with a single member, and skips any layout header (see
+// pmf.LayoutHeaderMagic) before the PMF data. size is the length of the PMF
+// data, or -1 for gzip, whose length is only known once it has been read
+// through. An uncompressed PMF can still be read out of order.
+func openPMF(path string) (r io.ReadCloser, size int, err error) {
+	in, size, err := openFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if f, ok := in.(*os.File); ok {
+		_, n, err := pmf.ReadLayoutHeader(bufio.NewReader(io.NewSectionReader(f, 0, int64(size))))
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		if n == 0 {
+			return f, size, nil
+		}
+		return &pmfSection{io.NewSectionReader(f, int64(n), int64(size-n)), f}, size - n, nil
+	}
+
+	br := bufio.NewReader(in)
+	_, n, err := pmf.ReadLayoutHeader(br)
+	if err != nil {
+		in.Close()
+		return nil, 0, err
+	}
+	if size >= 0 {
+		size -= n
+	}
+	return &readClosers{br, []io.Closer{in}}, size, nil
+}
+
+// embeddedLayout returns the track table held in the layout header of the
+// PMF at path, and whether it has one.
+func embeddedLayout(path string) (layout []byte, ok bool, err error) {
+	in, _, err := openFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer in.Close()
+	layout, n, err := pmf.ReadLayoutHeader(bufio.NewReader(in))
+	return layout, n > 0, err
+}
+
+// openFile opens the file at path as openPMF does, without looking for a
+// layout header.
+func openFile(path string) (r io.ReadCloser, size int, err error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return &readClosers{gz, []io.Closer{gz, f}}, -1, nil
+	case ".zip":
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		var member *zip.File
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			if member != nil {
+				zr.Close()
+				return nil, 0, fmt.Errorf("archive holds more than one file")
+			}
+			member = f
+		}
+		if member == nil {
+			zr.Close()
+			return nil, 0, fmt.Errorf("archive is empty")
+		}
+		rc, err := member.Open()
+		if err != nil {
+			zr.Close()
+			return nil, 0, err
+		}
+		return &readClosers{rc, []io.Closer{rc, zr}}, int(member.UncompressedSize64), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, int(fi.Size()), nil
+}
+
+// pmfSection is the PMF data of an uncompressed file after its layout
+// header.
+type pmfSection struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// readClosers reads from a decompressor and closes it along with the
+// readers beneath it.
+type readClosers struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readClosers) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// bufferPMF reads the PMF from in, of size bytes (-1 if unknown), into
+// memory if it is no longer than limit, and returns the reader to convert it
+// from and its size. In memory it is read in one go, and can be read out of
+// order, which lets a compressed PMF have its size checked up front and its
+// audio byte order detected. A longer PMF, or any with a limit of 0, is
+// streamed from in, after what was read of it.
+func bufferPMF(in io.Reader, size int, limit int64) (io.Reader, int, error) {
+	if limit <= 0 || int64(size) > limit {
+		return in, size, nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(in, limit+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(len(data)) > limit {
+		return io.MultiReader(bytes.NewReader(data), in), size, nil
+	}
+	return bytes.NewReader(data), len(data), nil
+}
+
+// parseSize parses a size in bytes, such as 512M: a whole number with an
+// optional K, M or G suffix (powers of 1024, case-insensitive).
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	shift := uint(0)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K', 'k':
+			shift = 10
+		case 'M', 'm':
+			shift = 20
+		case 'G', 'g':
+			shift = 30
+		}
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size %s out of range", s)
+	}
+	return n << shift, nil
+}
+
+// fileExists reports whether path names an existing file.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// convertPremaster turns the premaster pmfPath/ffPath into a BIN/CUE pair
+// named after the .pmf file.
+func convertPremaster(pmfPath, ffPath string, opts *options) error {
+	base := pmfPath
+	switch strings.ToLower(filepath.Ext(base)) {
+	case ".gz", ".zip":
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	if strings.HasSuffix(strings.ToLower(base), ".pmf") {
+		base = base[:len(base)-len(".pmf")]
+	} else {
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+
+	if opts.check || opts.json {
+		return checkLayout(pmfPath, ffPath, opts)
+	}
+	if opts.roundTrip {
+		return roundTrip(pmfPath, ffPath, opts)
+	}
+	if opts.dryRun {
+		return dryRun(pmfPath, ffPath, base, opts)
+	}
+	if opts.previews {
+		return writePreviews(pmfPath, ffPath, base, opts)
+	}
+
+	if err := keepLayoutCue(ffPath, base, opts); err != nil {
+		return err
+	}
+	in, size, err := openPMF(pmfPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", pmfPath, err)
+	}
+	defer in.Close()
+	r, size, err := bufferPMF(in, size, opts.maxMemory)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", pmfPath, err)
+	}
+
+	// Without a size up front, a compressed PMF is checked as it is read
+	tracks, disc, err := parseLayout(ffPath, pmfPath, size, opts)
+	if err != nil {
+		return fmt.Errorf("Failed to parse/validate %s: %v", ffPath, err)
+	}
+	return writeImage(r, pmfPath, tracks, disc, base, opts)
+}
+
+// parseLayout reads the track layout for the PMF at pmfPath ("" for
+// standard input), of pmfLen bytes, from ffPath: a .pmf.ff, the PMF's own
+// layout header if ffPath is pmfPath or, for premasters without either, a
+// cue sheet, along with the settings it declares for the whole disc.
+func parseLayout(ffPath, pmfPath string, pmfLen int, opts *options) ([]pmf.Track, pmf.Disc, error) {
+	if pmfPath != "" && ffPath == pmfPath {
+		layout, ok, err := embeddedLayout(pmfPath)
+		if err == nil && !ok {
+			err = fmt.Errorf("no layout header")
+		}
+		if err != nil {
+			return nil, pmf.Disc{}, err
+		}
+		return pmf.ParseFFReader(bytes.NewReader(layout), pmfLen, pmfOptions(opts))
+	}
+	if !strings.EqualFold(filepath.Ext(ffPath), ".cue") {
+		return pmf.ParseFF(ffPath, pmfLen, pmfOptions(opts))
+	}
+
+	// Form 2 sectors are told apart by reading the PMF, where it can be
+	// read out of order
+	var data io.ReaderAt
+	if pmfPath == "" {
+		if fi, err := os.Stdin.Stat(); err == nil && fi.Mode().IsRegular() {
+			data = os.Stdin
+		}
+	} else if in, _, err := openPMF(pmfPath); err == nil {
+		defer in.Close()
+		if ra, ok := in.(io.ReaderAt); ok {
+			data = ra
+		}
+	}
+	return pmf.ParseCueLayout(ffPath, data, pmfLen, pmfOptions(opts))
+}
+
+// convertStdin converts a PMF read from standard input, with the track table
+// from the .pmf.ff named by -ff.
+func convertStdin(opts *options) error {
+	pmfLen := -1 // unknown when reading from a pipe
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode().IsRegular() {
+		pmfLen = int(fi.Size())
+	}
+	tracks, disc, err := parseLayout(opts.ffPath, "", pmfLen, opts)
+	if err != nil {
+		return fmt.Errorf("Failed to parse/validate %s: %v", opts.ffPath, err)
+	}
+	base := opts.ffPath
+	if strings.HasSuffix(strings.ToLower(base), ".pmf.ff") {
+		base = base[:len(base)-len(".pmf.ff")]
+	} else {
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	if err := keepLayoutCue(opts.ffPath, base, opts); err != nil {
+		return err
+	}
+	return writeImage(os.Stdin, "standard input", tracks, disc, base, opts)
+}
+
+// keepLayoutCue fails if the cue sheet written for the image named base
+// would replace the cue sheet at ffPath that its layout is read from.
+func keepLayoutCue(ffPath, base string, opts *options) error {
+	if !strings.EqualFold(filepath.Ext(ffPath), ".cue") || opts.toc || opts.gdi || opts.iso {
+		return nil
+	}
+	sheet := base + ".cue"
+	switch opts.output {
+	case "":
+	case "-":
+		sheet = opts.cuePath
+	default:
+		sheet = opts.output + ".cue"
+	}
+	if sheet != "" && filepath.Clean(sheet) == filepath.Clean(ffPath) {
+		return fmt.Errorf("the new cue sheet would replace %s, which the layout is read from; name the output with -o", ffPath)
+	}
+	return nil
+}
+
+// previewSeconds is the length of the -endian-swap-all WAV previews.
+const previewSeconds = 5
+
+// writePreviews writes WAV previews of the premaster's first audio track in
+// both byte orders, named after base unless -o is given.
+func writePreviews(pmfPath, ffPath, base string, opts *options) error {
+	in, size, err := openPMF(pmfPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", pmfPath, err)
+	}
+	defer in.Close()
+	ra, ok := in.(io.ReaderAt)
+	if !ok {
+		return fmt.Errorf("-endian-swap-all needs an uncompressed PMF")
+	}
+
+	tracks, _, err := parseLayout(ffPath, pmfPath, size, opts)
+	if err != nil {
+		return fmt.Errorf("Failed to parse/validate %s: %v", ffPath, err)
+	}
+	if opts.output != "" {
+		base = opts.output
+	}
+	lsb, msb := base+" (AUDIO_LSB).wav", base+" (AUDIO_MSB).wav"
+	if err := pmf.WriteAudioPreviews(ra, int64(size), tracks, previewSeconds, lsb, msb); err != nil {
+		return fmt.Errorf("Failed to write previews of %s: %v", pmfPath, err)
+	}
+	info.Printf("Listen to both; the right byte order sounds clean, the wrong one like static")
+	return nil
+}
+
+// writeImage builds the BIN image from the PMF data in r, read from source,
+// along with the cue sheet and any other requested files, named after base
+// unless -o is given, and adds the conversion to the -report file. disc is
+// what the layout declared for the whole disc.
+func writeImage(r io.Reader, source string, tracks []pmf.Track, disc pmf.Disc, base string, opts *options) error {
+	if opts.report == nil {
+		_, err := buildImage(r, source, tracks, disc, base, opts, nil)
+		return err
+	}
+	start := time.Now()
+	in := r
+	pmfBytes := int64(-1)
+	// A PMF that allows random access is left unwrapped for byte order
+	// detection, which needs it; being read to the end, its size is the
+	// byte count
+	switch p := r.(type) {
+	case *os.File:
+		if fi, err := p.Stat(); err == nil && fi.Mode().IsRegular() {
+			pmfBytes = fi.Size()
+		}
+	case interface{ Size() int64 }:
+		// Read into memory, or a file after its layout header
+		pmfBytes = p.Size()
+	}
+	counter := &countingReader{r: r}
+	if pmfBytes < 0 {
+		in = counter
+	}
+
+	var stats pmf.Stats
+	outputs, err := buildImage(in, source, tracks, disc, base, opts, &stats)
+	if err != nil {
+		return err
+	}
+	if pmfBytes < 0 {
+		pmfBytes = counter.n
+	}
+	return opts.report.add(source, pmfBytes, tracks, pmf.DiscTOC(tracks, pmfOptions(opts)), sectorBytes(opts), outputs, stats, warnings.current(), time.Since(start))
+}
+
+// buildImage does the work of writeImage and returns the paths of the files
+// written, "-" standing for standard output. stats, if not nil, receives the
+// EDC counts of the image.
+func buildImage(r io.Reader, source string, tracks []pmf.Track, disc pmf.Disc, base string, opts *options, stats *pmf.Stats) (_ []string, err error) {
+	if opts.logicalPregap {
+		for i := range tracks {
+			tracks[i].LogicalPregap = true
+		}
+	}
+
+	popts := pmfOptions(opts)
+	popts.Disc = disc
+	if stats == nil {
+		// Still needed for the byte order
+		stats = new(pmf.Stats)
+	}
+	popts.Stats = stats
+	var hasher *pmf.Hasher
+	if opts.hash {
+		hasher = pmf.NewHasher(tracks)
+		popts.Tee = hasher
+	}
+
+	if opts.progress && isTerminal(os.Stderr) {
+		popts.Progress = progressPrinter(os.Stderr)
+	}
+
+	if opts.output == "-" {
+		if err := writeStdout(r, source, tracks, popts, opts); err != nil {
+			return nil, err
+		}
+		if hasher != nil {
+			// Standard output carries the image
+			printHashes(os.Stderr, filepath.Base(base+".bin"), hasher)
+		}
+		outputs := []string{"-"}
+		if opts.cuePath != "" {
+			outputs = append(outputs, opts.cuePath)
+		}
+		return outputs, nil
+	}
+
+	if opts.output != "" {
+		if err := os.MkdirAll(filepath.Dir(opts.output), 0755); err != nil {
+			return nil, fmt.Errorf("Failed to create output directory: %v", err)
+		}
+		base = opts.output
+	}
+	if opts.iso {
+		outISO := base + ".iso"
+		if err := pmf.BuildISO(opts.ctx, r, tracks, outISO, popts); err != nil {
+			return nil, fmt.Errorf("Failed to build iso %s: %v", outISO, err)
+		}
+		return []string{outISO}, nil
+	}
+
+	outBin := base + ".bin"
+
+	outBins, err := splitFileNames(base, tracks, opts) // -split, -group-by-mode: the file of each track
+	if err != nil {
+		return nil, err
+	}
+
+	// The files written make no image without the ones after them
+	var written outputSet
+	defer func() {
+		written.finish(err, opts.keepPartial)
+	}()
+
+	if outBins != nil {
+		for _, bin := range distinctNames(outBins) {
+			if err := written.add(bin); err != nil {
+				return nil, err
+			}
+		}
+		err = pmf.BuildSplitBin(opts.ctx, r, tracks, outBins, popts)
+	} else if opts.appendFrom >= 0 {
+		// Updated in place, not created by this run
+		outBins = []string{outBin}
+		popts.StartSector = opts.appendFrom
+		err = pmf.UpdateBin(opts.ctx, r, tracks, outBin, popts)
+	} else {
+		outBins = []string{outBin}
+		if err := written.add(outBin); err != nil {
+			return nil, err
+		}
+		err = pmf.BuildBinContext(opts.ctx, r, tracks, outBin, popts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to build bin %s: %v", outBin, err)
+	}
+
+	if hasher != nil {
+		printHashes(os.Stdout, filepath.Base(outBin), hasher)
+	}
+
+	// As detected while building, if not declared
+	popts.AudioMSB = stats.AudioMSB
+	if opts.remMetadata {
+		popts.CueRem = cueRemarks(source, tracks, popts.AudioMSB)
+	}
+	outputs := distinctNames(outBins)
+
+	sheet := base + ".cue"
+	if opts.gdi {
+		sheet = base + ".gdi"
+	} else if opts.toc && !opts.split && !opts.groupByMode {
+		sheet = base + ".toc"
+	}
+	if err := written.add(sheet); err != nil {
+		return nil, err
+	}
+	if opts.gdi {
+		if err := pmf.WriteGDI(tracks, sheet, outBins); err != nil {
+			return nil, fmt.Errorf("Failed to write gdi %s: %v", sheet, err)
+		}
+	} else if opts.split || opts.groupByMode {
+		if err := pmf.WriteSplitCue(tracks, sheet, outBins, popts); err != nil {
+			return nil, fmt.Errorf("Failed to write cue %s: %v", sheet, err)
+		}
+	} else if opts.toc {
+		if err := pmf.WriteTOC(tracks, sheet, outBin, popts.Disc); err != nil {
+			return nil, fmt.Errorf("Failed to write toc %s: %v", sheet, err)
+		}
+	} else {
+		if err := pmf.WriteCue(tracks, sheet, outBin, popts); err != nil {
+			return nil, fmt.Errorf("Failed to write cue %s: %v", sheet, err)
+		}
+	}
+
+	outputs = append(outputs, sheet)
+
+	if opts.sub {
+		outSub := base + ".sub"
+		if err := written.add(outSub); err != nil {
+			return nil, err
+		}
+		if err := pmf.WriteSub(tracks, outSub, popts); err != nil {
+			return nil, fmt.Errorf("Failed to write subchannel %s: %v", outSub, err)
+		}
+		outputs = append(outputs, outSub)
+	}
+
+	if opts.ccd {
+		outCCD := base + ".ccd"
+		if err := written.add(outCCD); err != nil {
+			return nil, err
+		}
+		if err := pmf.WriteCCD(tracks, outCCD, popts); err != nil {
+			return nil, fmt.Errorf("Failed to write ccd %s: %v", outCCD, err)
+		}
+		outputs = append(outputs, outCCD)
+	}
+
+	// The image is complete; if chdman fails it is kept
+	written.finish(nil, false)
+	written = outputSet{}
+	if opts.chd {
+		if err := makeCHD(sheet, base+".chd"); err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, base+".chd")
+		if opts.chdOnly {
+			bins := distinctNames(outBins)
+			for _, bin := range bins {
+				os.Remove(bin)
+			}
+			os.Remove(sheet)
+			info.Printf("Removed %s and %s", strings.Join(bins, ", "), sheet)
+			outputs = outputs[len(bins)+1:]
+		}
+	}
+	return outputs, nil
+}
+
+// printHashes prints the size, CRC32, MD5 and SHA-1 of the image and of each
+// track as datfile rom entries, named the way a per-track split of the image
+// would be.
+func printHashes(w io.Writer, binName string, h *pmf.Hasher) {
+	image := h.Image()
+	fmt.Fprintf(w, "\n<rom name=\"%s\" size=\"%d\" crc=\"%08x\" md5=\"%x\" sha1=\"%x\"/>\n", binName, image.Size, image.CRC32, image.MD5, image.SHA1)
+	stem := strings.TrimSuffix(binName, filepath.Ext(binName))
+	digests := h.Tracks()
+	if len(digests) == 1 {
+		// The track is the whole image
+		return
+	}
+	for i, d := range digests {
+		fmt.Fprintf(w, "<rom name=\"%s\" size=\"%d\" crc=\"%08x\" md5=\"%x\" sha1=\"%x\"/>\n", pmf.TrackFileName(stem, i+1, len(digests)), d.Size, d.CRC32, d.MD5, d.SHA1)
+	}
+}
+
+// writeStdout writes the BIN image to standard output and, if -cue is given,
+// the cue sheet (or TOC) to that file, referring to the image by the same
+// name with a .bin extension.
+func writeStdout(r io.Reader, source string, tracks []pmf.Track, popts pmf.Options, opts *options) error {
+	if opts.cuePath != "" {
+		if err := os.MkdirAll(filepath.Dir(opts.cuePath), 0755); err != nil {
+			return fmt.Errorf("Failed to create output directory: %v", err)
+		}
+	}
+	if err := pmf.WriteBin(opts.ctx, r, tracks, os.Stdout, popts); err != nil {
+		return fmt.Errorf("Failed to write bin to standard output: %v", err)
+	}
+	if opts.cuePath == "" {
+		return nil
+	}
+	popts.AudioMSB = popts.Stats.AudioMSB
+
+	binName := strings.TrimSuffix(opts.cuePath, filepath.Ext(opts.cuePath)) + ".bin"
+	if opts.remMetadata {
+		popts.CueRem = cueRemarks(source, tracks, popts.AudioMSB)
+	}
+	if opts.toc {
+		if err := pmf.WriteTOC(tracks, opts.cuePath, binName, popts.Disc); err != nil {
+			return fmt.Errorf("Failed to write toc %s: %v", opts.cuePath, err)
+		}
+		return nil
+	}
+	if err := pmf.WriteCue(tracks, opts.cuePath, binName, popts); err != nil {
+		return fmt.Errorf("Failed to write cue %s: %v", opts.cuePath, err)
+	}
+	return nil
+}
+
+// add records a finished conversion and rewrites the report file.
+func (rep *runReport) add(source string, pmfBytes int64, tracks []pmf.Track, toc pmf.TOC, sector int64, outputs []string, stats pmf.Stats, warned []string, elapsed time.Duration) error {
+	c := conversionJSON{
+		Source:         source,
+		PMFBytes:       pmfBytes,
+		TOC:            toc,
+		DataSectors:    stats.DataSectors,
+		ZeroEDCSectors: stats.ZeroEDCSectors,
+		Warnings:       warned,
+		Seconds:        elapsed.Seconds(),
+	}
+	imageBytes := int64(0)
+	for _, t := range tracks {
+		tr := trackReportJSON{
+			Track:   t,
+			Type:    t.Type(),
+			Sectors: t.ImageSectors(),
+			Bytes:   int64(t.ImageSectors()) * sector,
 		}
-		} else {
-			fmt.Printf("Usage: %s <file.pmf.ff>", os.Args[0])
-			return
+		imageBytes += tr.Bytes
+		c.Tracks = append(c.Tracks, tr)
+	}
+	for _, path := range outputs {
+		out := outputJSON{Path: path, Bytes: imageBytes}
+		if path != "-" {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return fmt.Errorf("Failed to write report %s: %v", rep.path, err)
+			}
+			out.Bytes = fi.Size()
 		}
-	} else {
-		path = os.Args[1]
+		c.Outputs = append(c.Outputs, out)
 	}
+	rep.Conversions = append(rep.Conversions, c)
 
-	base := strings.TrimSuffix(strings.TrimSuffix(path, ".ff"), ".pmf")
-	pmfPath := base + ".pmf"
-	ffPath := base + ".pmf.ff"
-	pmf, err := ioutil.ReadFile(pmfPath)
+	data, err := json.MarshalIndent(rep, "", "  ")
 	if err != nil {
-		log.Printf("Failed to read %s: %v", pmfPath, err)
-		return
+		return fmt.Errorf("Failed to write report %s: %v", rep.path, err)
 	}
-
-	tracks, err := parseFF(ffPath, len(pmf))
-	if err != nil {
-		log.Printf("Failed to parse/validate %s: %v", ffPath, err)
-		return
+	if err := writeFileAtomic(rep.path, append(data, '\n')); err != nil {
+		return fmt.Errorf("Failed to write report %s: %v", rep.path, err)
 	}
+	return nil
+}
 
-	outBin := base + ".bin"
-	outCue := base + ".cue"
-
-	err = buildBin(pmf, tracks, outBin)
-	if err != nil {
-		log.Printf("Failed to build bin %s: %v", outBin, err)
-		return
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
 	}
-
-	err = writeCue(tracks, outCue, outBin)
-	if err != nil {
-		log.Printf("Failed to write cue %s: %v", outCue, err)
-		return
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
 	}
-
-	fmt.Println("\nDone!")
+	return nil
 }
 
-func pauseOnExit() {
-	fmt.Println("\nPress Enter to exit...")
-	bufio.NewReader(os.Stdin).ReadBytes('\n')
+// countingReader passes reads through to r, counting the bytes read.
+type countingReader struct {
+	r io.Reader
+	n int64
 }
 
-func setConsoleTitle(title string) {
-	switch runtime.GOOS {
-	case "windows":
-		// Use CMD method; works in both CMD and PowerShell
-		cmd := exec.Command("cmd", "/C", "title", title)
-		cmd.Run() // ignore errors for simplicity
-	case "linux", "darwin":
-		// ANSI escape sequence for most terminals
-		fmt.Printf("\033]0;%s\007", title)
-	}
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }
 
-func parseFF(ffPath string, pmfLen int) (tracks []Track, err error) {
-	f, err := os.Open(ffPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open %s: %v", ffPath, err)
-	}
-	defer func() {
-		// Always attempt to close, even if an earlier error occurred
-		closeErr := f.Close()
-		if err == nil && closeErr != nil {
-			err = fmt.Errorf("Close failed: %v", closeErr)
-		}
-	}()
+// warningLog collects the warnings written to it, one per Write as from a
+// log.Logger, noting the file being converted with each.
+type warningLog struct {
+	entries []warning
+	source  string // the file being converted, in a batch
+	first   int    // the first entry of the current conversion
+	verbose bool   // also print each warning as it is written
+}
 
-	scanner := bufio.NewScanner(f)
-	var numExpected int
-	inSection := false
+type warning struct {
+	source, msg string
+}
 
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+func (w *warningLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	if w.verbose {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", msg)
+	}
+	w.entries = append(w.entries, warning{w.source, msg})
+	return len(p), nil
+}
 
-		// Skip empty lines
-		if line == "" {
-			continue
-		}
-		// Detect audio byte order
-		if strings.HasPrefix(line, "AUDIO_BYTE_ORDER:") {
-			order := strings.TrimSpace(strings.TrimPrefix(line, "AUDIO_BYTE_ORDER:"))
-			audioMSB = order == "AUDIO_MSB"
-			continue
-		}
-		// Detect number of tracks
-		if strings.HasPrefix(line, "%NUMBER_OF_ADDED_TRACKS") {
-			fmt.Sscanf(line, "%%NUMBER_OF_ADDED_TRACKS %d", &numExpected)
-			continue
-		}
-		if strings.HasPrefix(line, "%START_OF_ADDED_TRACK_DATA") {
-			inSection = true
-			continue
-		}
-		if !inSection {
-			continue
-		}
+// begin starts a new conversion, of source.
+func (w *warningLog) begin(source string) {
+	w.source = source
+	w.first = len(w.entries)
+}
 
-		var t Track
-		_, err := fmt.Sscanf(line, "%d %d %d %d", &t.Num, &t.Mode, &t.Start, &t.End)
-		if err != nil {
-			continue // skip malformed line
-		}
-		tracks = append(tracks, t)
+// current returns the warnings of the conversion begun last.
+func (w *warningLog) current() []string {
+	var msgs []string
+	for _, e := range w.entries[w.first:] {
+		msgs = append(msgs, e.msg)
 	}
+	return msgs
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading %s: %v", ffPath, err)
+// summarize prints an "N warnings:" block listing every warning collected,
+// each with its file when converting several, or nothing if there were none.
+func (w *warningLog) summarize(out io.Writer) {
+	if len(w.entries) == 0 {
+		return
 	}
-
-	if len(tracks) == 0 {
-		return nil, fmt.Errorf("no tracks found in pmf.ff")
+	noun := "warnings"
+	if len(w.entries) == 1 {
+		noun = "warning"
 	}
-
-	if numExpected > 0 && len(tracks) != numExpected {
-		return nil, fmt.Errorf("track count mismatch: expected %d, found %d",
-			numExpected, len(tracks))
+	fmt.Fprintf(out, "\n%d %s:\n", len(w.entries), noun)
+	for _, e := range w.entries {
+		if e.source != "" {
+			fmt.Fprintf(out, "  %s: %s\n", e.source, e.msg)
+		} else {
+			fmt.Fprintf(out, "  %s\n", e.msg)
+		}
 	}
+}
 
-	// Validate each track
-	for i := range tracks {
-		t := &tracks[i]
-
-		// Mode check
-		if t.Mode != 2 && t.Mode != 4 {
-			return nil, fmt.Errorf("track %d has invalid mode %d", t.Num, t.Mode)
+// splitFileNames returns the file of each track for -split and
+// -group-by-mode, with .wav files for the audio tracks under -wav, or nil for
+// a single .bin.
+func splitFileNames(base string, tracks []pmf.Track, opts *options) ([]string, error) {
+	var names []string
+	switch {
+	case opts.split:
+		for _, t := range tracks {
+			names = append(names, pmf.TrackFileName(base, t.Num, len(tracks)))
 		}
-
-		// Sequential numbering check
-		if t.Num != i+1 {
-			return nil, fmt.Errorf("track numbering mismatch: got %d, expected %d", t.Num, i+1)
+	case opts.groupByMode:
+		var err error
+		if names, err = pmf.GroupFileNames(base, tracks); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	if opts.wav {
+		for i, t := range tracks {
+			if t.Mode == 4 {
+				names[i] = strings.TrimSuffix(names[i], ".bin") + ".wav"
+			}
 		}
+	}
+	return names, nil
+}
 
-		// Logical start/end
-		if t.Start > t.End {
-			return nil, fmt.Errorf("track %d start sector (%d) is after end sector (%d)", t.Num, t.Start, t.End)
+// outputSet is the files a conversion writes, so that a failure can remove
+// them and put back the files they replace. Those are moved to their .old
+// name before being overwritten, since each writer renames its finished
+// temporary file into place on its own.
+type outputSet struct {
+	paths    []string
+	replaced map[string]bool // paths whose previous file was moved aside
+}
+
+// add records path as written by this run, moving any file already there
+// aside.
+func (s *outputSet) add(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, path+".old"); err != nil {
+			return fmt.Errorf("Failed to move %s aside: %v", path, err)
 		}
+		if s.replaced == nil {
+			s.replaced = make(map[string]bool)
+		}
+		s.replaced[path] = true
+	}
+	s.paths = append(s.paths, path)
+	return nil
+}
 
-		// Pregap calculation
-		if i == 0 {
-			t.Pregap = 0
-		} else {
-			prev := &tracks[i-1]
-			t.Pregap = t.Start - prev.End - 1
-			if t.Pregap < 0 {
-				return nil, fmt.Errorf("track %d has negative pregap (%d sectors)", t.Num, t.Pregap)
+// finish drops the moved-aside files if err is nil. Otherwise it removes
+// the files written and puts back those they replaced; with keep, a
+// written file is left in place, or as its temporary name if it replaced
+// one.
+func (s *outputSet) finish(err error, keep bool) {
+	for _, path := range s.paths {
+		switch {
+		case err == nil:
+			if s.replaced[path] {
+				os.Remove(path + ".old")
 			}
-			if t.Start <= prev.End {
-				return nil, fmt.Errorf("track %d overlaps previous track (start=%d, prev end=%d)", t.Num, t.Start, prev.End)
+		case s.replaced[path]:
+			if keep {
+				os.Rename(path, pmf.TempPath(path))
+			} else {
+				os.Remove(path)
 			}
+			os.Rename(path+".old", path)
+		case !keep:
+			os.Remove(path)
 		}
+	}
+}
 
-		// Audio ordering warning
-		if i > 0 && tracks[i-1].Mode == 4 && t.Mode != 4 {
-			fmt.Printf("Warning: data track follows audio track (unusual ordering)\n")
+// distinctNames returns names without consecutive repeats, as in the list of
+// files written for -group-by-mode.
+func distinctNames(names []string) []string {
+	var out []string
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			out = append(out, name)
 		}
 	}
+	return out
+}
 
-	// Verify tracks align with PMF size
-	expectedSize := 0
+// cueRemarks returns the REM lines recording how an image was made: the
+// pmf2bin version, the date, the source PMF and, for discs with audio, the
+// byte order used for it: big-endian if audioMSB is set.
+func cueRemarks(source string, tracks []pmf.Track, audioMSB bool) []string {
+	rems := []string{
+		fmt.Sprintf("COMMENT \"pmf2bin %s\"", version),
+		"CONVERSION_DATE " + time.Now().Format("2006-01-02"),
+		fmt.Sprintf("SOURCE \"%s\"", filepath.Base(source)),
+	}
 	for _, t := range tracks {
-		sectorCount := t.End - t.Start + 1 // if End is inclusive
 		if t.Mode == 4 {
-			expectedSize += sectorCount * binSector
-		} else {
-			expectedSize += sectorCount * pmfSector
+			order := "AUDIO_LSB"
+			if audioMSB {
+				order = "AUDIO_MSB"
+			}
+			rems = append(rems, "AUDIO_BYTE_ORDER "+order)
+			break
 		}
 	}
-	if expectedSize != pmfLen {
-		return nil, fmt.Errorf("PMF length mismatch: expected %d bytes, got %d bytes", expectedSize, pmfLen)
+	return rems
+}
+
+// makeCHD compresses the image described by sheet into a CHD file with
+// MAME's chdman, passing its output through.
+func makeCHD(sheet, chdPath string) error {
+	cmd := exec.Command("chdman", "createcd", "-i", sheet, "-o", chdPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("chdman failed to create %s: %v", chdPath, err)
+	}
+	info.Printf("Wrote CHD image: %s", chdPath)
+	return nil
+}
+
+// sectorBytes returns the size of a sector in the image written with opts.
+func sectorBytes(opts *options) int64 {
+	if opts.subInterleave {
+		return pmf.BinSubSector
 	}
+	return pmf.BinSector
+}
 
-	return tracks, nil
+// pmfOptions returns the conversion settings passed to the pmf package.
+func pmfOptions(opts *options) pmf.Options {
+	popts := pmf.Options{
+		Workers:          opts.jobs,
+		Strict:           opts.strict,
+		RepairSubheader:  opts.repairSubhdr,
+		AllowTrailingPad: opts.trailingPad,
+		BlankPregap:      opts.blankPregap,
+		Scramble:         opts.scramble,
+		RequireByteOrder: opts.requireOrder,
+		PadAudio:         opts.padAudio,
+		PadMissing:       opts.padMissing,
+		KeepAudioMSB:     opts.keepMSB,
+		OutputAudioMSB:   opts.outMSB,
+		KeepPartial:      opts.keepPartial,
+		SubInterleaved:   opts.subInterleave,
+		Patches:          opts.patches,
+		PregapWarn:       opts.pregapWarn,
+		MaxPregap:        opts.maxPregap,
+		ZeroEDCWarn:      opts.zeroEDCWarn,
+		LeadIn:           opts.leadIn,
+		CueLeadIn:        opts.cueLeadIn,
+	}
+	if opts.leadIn == 0 {
+		popts.LeadIn = pmf.NoLeadIn
+	}
+	if opts.oversize {
+		popts.MaxSectors = pmf.MaxDiscSectors
+	}
+	return popts
 }
 
-func buildBin(pmf []byte, tracks []Track, outPath string) (err error) {
-	out, err := os.Create(outPath)
+// convertToPMF regenerates a .pmf/.pmf.ff premaster from the BIN/CUE image
+// described by cuePath. Existing premaster files are never overwritten.
+func convertToPMF(cuePath string, opts *options) error {
+	binPath, tracks, binMSB, err := pmf.ParseCue(cuePath)
 	if err != nil {
-		return fmt.Errorf("Failed to create %s: %v", outPath, err)
+		return fmt.Errorf("Failed to parse %s: %v", cuePath, subchannelError(err, "-bin2pmf"))
 	}
-	defer func() {
-		// Always attempt to close, even if an earlier error occurred
-		closeErr := out.Close()
-		if err == nil && closeErr != nil {
-			err = fmt.Errorf("Close failed: %v", closeErr)
-		}
-	}()
-	bw := bufio.NewWriter(out)
-	var sector [binSector]byte
-	empty := make([]byte, binSector)
-	offset := 0
 
-	for _, t := range tracks {
-		trackType := "MODE2"
-		if t.Mode == 4 {
-			trackType = "AUDIO"
-		}
-		min, sec, frame := lbaToMSF(t.Start)
-		fmt.Printf("Writing Track %d Type %s (%02d:%02d:%02d) Sectors %d–%d\n", t.Num, trackType, min, sec, frame, t.Start, t.End)
-
-		// Write pregap sectors
-		for s := 0; s < t.Pregap; s++ {
-			lba := t.Start - t.Pregap + s + 150
-			min, sec, frame := lbaToMSF(lba)
-
-			copy(sector[:], empty) // zeroes by default
-
-			if t.Mode == 2 {
-				// 12-byte sync
-				copy(sector[0:12], []byte{0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x00})
-				// 4-byte header with accurate MSF
-				sector[12] = toBCD(min)
-				sector[13] = toBCD(sec)
-				sector[14] = toBCD(frame)
-				sector[15] = byte(t.Mode)
-				// 8-byte subheader with submode byte signaling Mode 2 Form 1
-				//copy(sector[16:24], []byte{0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x20, 0x00})
-				// 4-byte end of pregap sector on many discs
-				//copy(sector[2044:2048], []byte{0x3F, 0x13, 0xB0, 0xBE})
-				// Data and ECC remain zeros
-			}
-			bw.Write(sector[:])
+	base := strings.TrimSuffix(cuePath, filepath.Ext(cuePath))
+	if opts.output != "" {
+		if err := os.MkdirAll(filepath.Dir(opts.output), 0755); err != nil {
+			return fmt.Errorf("Failed to create output directory: %v", err)
 		}
+		base = opts.output
+	}
+	outPMF := base + ".pmf"
+	outFF := base + ".pmf.ff"
+	for _, p := range []string{outPMF, outFF} {
+		if _, err := os.Stat(p); err == nil {
+			return fmt.Errorf("%s already exists, not overwriting", p)
+		}
+	}
 
-		// Write actual track sectors
-		for s := t.Start; s <= t.End; s++ {
-			lba := s + 150
-			min, sec, frame := lbaToMSF(lba)
-
-			copy(sector[:], empty) // zeros by default
+	if err := pmf.ExtractPMF(binPath, tracks, outPMF, binMSB, opts.audioMSB); err != nil {
+		return fmt.Errorf("Failed to extract %s: %v", outPMF, err)
+	}
+	if err := pmf.WriteFF(tracks, outFF, opts.audioMSB); err != nil {
+		return fmt.Errorf("Failed to write %s: %v", outFF, err)
+	}
+	return nil
+}
 
-			if t.Mode == 4 {
-				end := offset + binSector
-				if end > len(pmf) {
-					return fmt.Errorf("PMF truncated: need %d bytes, only %d available", end, len(pmf))
-				}
-				data := pmf[offset:end]
-			if audioMSB {
-				// Swap every pair of bytes (16-bit samples)
-				for i := 0; i+1 < len(data); i += 2 {
-					data[i], data[i+1] = data[i+1], data[i]
-				}
-			}
-				bw.Write(data)
-				offset = end
-				continue
-			}
+// list prints the track table of the BIN/CUE image described by cuePath.
+func list(cuePath string) error {
+	binPath, tracks, binMSB, err := pmf.ParseCue(cuePath)
+	if err != nil {
+		return fmt.Errorf("Failed to list %s: %v", cuePath, subchannelError(err, "-list"))
+	}
 
-			end := offset + pmfSector
-			if end > len(pmf) {
-				return fmt.Errorf("PMF truncated: need %d bytes, only %d available", end, len(pmf))
-			}
-			raw := pmf[offset:end]
-			sub := raw[:8]
-			data := raw[8:]
+	if binMSB {
+		fmt.Printf("%s (audio big-endian)\n", binPath)
+	} else {
+		fmt.Printf("%s\n", binPath)
+	}
+	fmt.Printf("Track  Type   Pregap  Start     End       Sectors  Bytes\n")
+	total := 0
+	for _, t := range tracks {
+		sectors := t.End - t.Start + 1
+		total += t.Pregap + sectors
+		fmt.Printf("%5d  %-5s  %6d  %s  %s  %7d  %d\n", t.Num, t.Type(), t.Pregap,
+			pmf.LBAToMSFFormatted(t.Start), pmf.LBAToMSFFormatted(t.End), sectors, int64(sectors)*pmf.BinSector)
+	}
+	fmt.Printf("Total sectors (including pregaps): %d (%s, %d bytes)\n", total, pmf.LBAToMSFFormatted(total), int64(total)*pmf.BinSector)
+	return nil
+}
 
-			// 12-byte sync
-			copy(sector[0:12], []byte{0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x00})
-			// 4-byte header with accurate MSF
-			sector[12] = toBCD(min)
-			sector[13] = toBCD(sec)
-			sector[14] = toBCD(frame)
-			sector[15] = byte(t.Mode)
-			// 8-byte subheader from PMF
-			copy(sector[16:24], sub)
-			// 2048 bytes of data
-			copy(sector[24:2072], data)
-			// 4-byte calculated EDC
-			edc := computeEDC(sector[16:2072])
-			copy(sector[2072:2076], edc[:])
-			// 172-byte P-parity
-			pParity := pParityLFSR(sector[12:2076])
-			copy(sector[2076:2248], pParity)
-			// 104-byte Q-parity
-			qParity := qParityLFSR(sector[12:2248])
-			copy(sector[2248:2352], qParity)
-			offset = end
-			bw.Write(sector[:])
+// verify checks the EDC and P/Q parity of every data sector in a BIN image.
+// A cue sheet next to the image, named like it, is only read to reject
+// images with 2448-byte sectors that the image size does not give away.
+func verify(binPath string) error {
+	if _, _, _, err := pmf.ParseCue(cueBeside(binPath)); errors.Is(err, pmf.ErrSubchannelImage) {
+		return fmt.Errorf("Failed to verify %s: %v", binPath, subchannelError(err, "-verify-bin"))
+	}
+	checked, failed, err := pmf.VerifyBin(binPath, func(lba int, c pmf.SectorCheck) {
+		var bad []string
+		if !c.EDC {
+			bad = append(bad, "EDC")
 		}
+		if !c.PParity {
+			bad = append(bad, "P-parity")
+		}
+		if !c.QParity {
+			bad = append(bad, "Q-parity")
+		}
+		fmt.Printf("Sector %d (%s): %s mismatch\n", lba, pmf.LBAToMSFFormatted(lba), strings.Join(bad, ", "))
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to verify %s: %v", binPath, subchannelError(err, "-verify-bin"))
 	}
 
-	if err := bw.Flush(); err != nil {
-		return fmt.Errorf("Flush failed: %v", err)
+	fmt.Printf("Checked %d sectors, %d with mismatches\n", checked, failed)
+	if failed > 0 {
+		return fmt.Errorf("%s has %d sectors with bad EDC/ECC", binPath, failed)
 	}
+	return nil
+}
 
-	if err := out.Sync(); err != nil {
-		return fmt.Errorf("Sync failed: %v", err)
+// inspect prints the fields of one sector of a BIN image, given as
+// file.bin:sector or file.bin:@offset, and whether its EDC and P/Q parity
+// match the ones computed from its data. The header address is shown as an
+// image position, with the -leadin offset removed.
+func inspect(arg string, opts *options) error {
+	i := strings.LastIndex(arg, ":")
+	if i <= 0 {
+		return usageError{"-inspect needs file.bin:sector or file.bin:@offset"}
+	}
+	binPath, where := arg[:i], arg[i+1:]
+	var offset int64
+	if strings.HasPrefix(where, "@") {
+		n, err := strconv.ParseInt(where[1:], 0, 64)
+		if err != nil || n < 0 {
+			return usageError{fmt.Sprintf("-inspect: invalid byte offset %q", where[1:])}
+		}
+		offset = n
+	} else {
+		n, err := strconv.Atoi(where)
+		if err != nil || n < 0 {
+			return usageError{fmt.Sprintf("-inspect: invalid sector %q", where)}
+		}
+		offset = int64(n) * pmf.BinSector
 	}
 
-	fmt.Printf("Wrote BIN image: %s\n", outPath)
+	f, err := os.Open(binPath)
+	if err != nil {
+		return fmt.Errorf("Failed to inspect %s: %v", binPath, err)
+	}
+	defer f.Close()
+	sector := make([]byte, pmf.BinSector)
+	if _, err := f.ReadAt(sector, offset); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%s has no whole sector at offset %d", binPath, offset)
+	} else if err != nil {
+		return fmt.Errorf("Failed to read the sector at offset %d of %s: %v", offset, binPath, err)
+	}
 
-	if offset != len(pmf) {
-		return fmt.Errorf("PMF file not fully consumed: %d bytes remaining", len(pmf)-offset)
+	if offset%pmf.BinSector == 0 {
+		fmt.Printf("Sector %d of %s (offset %d)\n", offset/pmf.BinSector, binPath, offset)
+	} else {
+		fmt.Printf("%d bytes at offset %d of %s (not on a sector boundary)\n", pmf.BinSector, offset, binPath)
+	}
+	info := pmf.InspectSector(sector, pmfOptions(opts))
+	if !info.Sync {
+		fmt.Printf("Sync:       missing; audio, or not the start of a sector\n")
+		return nil
+	}
+	fmt.Printf("Sync:       valid\n")
+	address := "not BCD"
+	if info.Address >= 0 {
+		address = fmt.Sprintf("%s = sector %d", pmf.LBAToMSFFormatted(info.Address), info.Address)
+	}
+	fmt.Printf("Header:     % X  (%s with the lead-in removed, mode %d)\n", info.Header, address, info.Mode)
+	if info.Subheader != nil {
+		copies := "copies match"
+		if !pmf.SubheaderCopiesMatch(info.Subheader) {
+			copies = "copies differ"
+		}
+		submode := strings.Join(info.Submode, ", ")
+		if submode == "" {
+			submode = "none"
+		}
+		fmt.Printf("Subheader:  % X  (file %d, channel %d, submode %02X: %s, coding %02X; %s)\n",
+			info.Subheader, info.Subheader[0], info.Subheader[1], info.Subheader[2], submode, info.Subheader[3], copies)
+		form := 1
+		if info.Form2 {
+			form = 2
+		}
+		fmt.Printf("Form:       %d\n", form)
+	}
+	if info.StoredEDC == nil {
+		fmt.Printf("Mode %d sectors carry no EDC or parity\n", info.Mode)
+		return nil
 	}
+	fmt.Printf("EDC:        stored % X, computed % X: %s\n", info.StoredEDC, info.ComputedEDC, matchText(bytes.Equal(info.StoredEDC, info.ComputedEDC)))
+	if info.Form2 {
+		fmt.Printf("Parity:     none in Form 2 sectors (a zero EDC means none was recorded)\n")
+		return nil
+	}
+	fmt.Printf("P-parity:   %s\n", matchText(info.Check.PParity))
+	fmt.Printf("Q-parity:   %s\n", matchText(info.Check.QParity))
 	return nil
 }
 
-func writeCue(tracks []Track, cuePath, binName string) (err error) {
-	out, err := os.Create(cuePath)
-	if err != nil {
-		return fmt.Errorf("Failed to write cue: %v", err)
+// matchText describes the result of comparing a stored value with the
+// computed one.
+func matchText(ok bool) string {
+	if ok {
+		return "match"
 	}
-	defer func() {
-		// Always attempt to close, even if an earlier error occurred
-		closeErr := out.Close()
-		if err == nil && closeErr != nil {
-			err = fmt.Errorf("Close failed: %v", closeErr)
-		}
-	}()
+	return "mismatch"
+}
 
-	fmt.Fprintf(out, "FILE \"%s\" BINARY\n", filepath.Base(binName))
-	for _, t := range tracks {
-		if t.Mode == 4 {
-			fmt.Fprintf(out, "  TRACK %02d AUDIO\n", t.Num)
-		} else {
-			fmt.Fprintf(out, "  TRACK %02d MODE2/2352\n", t.Num)
+// fixECC rewrites the EDC and P/Q parity of the data sectors of a BIN image
+// that differ from the recomputed ones. A cue sheet next to the image, named
+// like it, gives the track modes; without one the sector headers do.
+func fixECC(binPath string) error {
+	var tracks []pmf.Track
+	cuePath := cueBeside(binPath)
+	if _, err := os.Stat(cuePath); err == nil {
+		// Audio sectors are left alone, so their byte order does not matter
+		cueBin, cueTracks, _, err := pmf.ParseCue(cuePath)
+		if err != nil {
+			return fmt.Errorf("Failed to read %s: %v", cuePath, subchannelError(err, "-fix-ecc"))
 		}
-
-		if t.Pregap > 0 {
-			min, sec, frame := lbaToMSF(t.Start - t.Pregap)
-			fmt.Fprintf(out, "    INDEX 00 %02d:%02d:%02d\n", min, sec, frame)
+		if !sameFile(cueBin, binPath) {
+			return fmt.Errorf("%s describes %s, not %s", cuePath, cueBin, binPath)
 		}
-		fmt.Fprintf(out, "    INDEX 01 %s\n", lbaToMSFFormatted(t.Start))
+		tracks = cueTracks
+		info.Printf("Taking the track modes from %s", cuePath)
+	}
+
+	checked, fixed, err := pmf.FixBin(binPath, tracks)
+	if err != nil {
+		return fmt.Errorf("Failed to fix %s: %v", binPath, subchannelError(err, "-fix-ecc"))
 	}
-	fmt.Printf("Wrote CUE sheet: %s\n", cuePath)
+	fmt.Printf("Checked %d sectors, corrected %d\n", checked, fixed)
 	return nil
 }
 
-func toBCD(value int) byte {
-	return byte((value/10)<<4 | (value%10))
+// cueBeside returns the path of the cue sheet named like the BIN image at
+// binPath, in the same directory.
+func cueBeside(binPath string) string {
+	return strings.TrimSuffix(binPath, filepath.Ext(binPath)) + ".cue"
 }
 
-func lbaToMSF(lba int) (int, int, int) {
-	min := lba / (60 * 75)
-	sec := (lba / 75) % 60
-	frame := lba % 75
-	return min, sec, frame
+// subchannelError rewords an ErrSubchannelImage error to name the option
+// that cannot handle such images, and returns any other error unchanged.
+func subchannelError(err error, option string) error {
+	if errors.Is(err, pmf.ErrSubchannelImage) {
+		return fmt.Errorf("%d-byte images are not supported by %s (%v)", pmf.BinSubSector, option, err)
+	}
+	return err
 }
 
-func lbaToMSFFormatted(lba int) string {
-	min, sec, frame := lbaToMSF(lba)
-	return fmt.Sprintf("%02d:%02d:%02d", min, sec, frame)
+// sameFile reports whether the paths a and b name the same existing file.
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
 }
 
-// computeEDC calculates the 32-bit EDC (Error Detection Code) for a CD-ROM XA Mode 2 Form 1 sector.
-// It uses a reflected CRC-32 with polynomial 0x04C11DB7 (reflected as 0xD8018001).
-// The EDC covers 2072 bytes from sync header through user data.
-// Unlike standard CRC-32, no initial or final XOR is applied.
-func computeEDC(data []byte) [4]byte {
-	var edc uint32 = 0
+// checkLayout validates the .pmf.ff against the size of the .pmf and prints
+// the resulting track table, or its JSON form, without reading the PMF data
+// or writing output.
+func checkLayout(pmfPath, ffPath string, opts *options) error {
+	size, err := pmfSize(pmfPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", pmfPath, err)
+	}
 
-	for _, b := range data {
-		// Standard reflected CRC-32: XOR byte with accumulator LSB,
-		// lookup precomputed value, XOR with shifted accumulator
-		index := byte(edc) ^ b
-		edc = (edc >> 8) ^ edcLUT[index]
+	tracks, disc, err := parseLayout(ffPath, pmfPath, size, opts)
+	if err != nil {
+		return fmt.Errorf("Failed to parse/validate %s: %v", ffPath, err)
 	}
 
-	// Return in little-endian byte order
-	return [4]byte{
-		byte(edc),
-		byte(edc >> 8),
-		byte(edc >> 16),
-		byte(edc >> 24),
+	if opts.json {
+		layout := layoutJSON{
+			PMF:          pmfPath,
+			FF:           ffPath,
+			AudioMSB:     disc.AudioMSB,
+			ExpectedSize: pmf.ExpectedSize(tracks),
+			PMFSize:      size,
+			TOC:          pmf.DiscTOC(tracks, pmfOptions(opts)),
+		}
+		for _, t := range tracks {
+			tj := trackJSON{
+				Track:    t,
+				Type:     t.Type(),
+				StartMSF: pmf.LBAToMSFFormatted(t.Start),
+				EndMSF:   pmf.LBAToMSFFormatted(t.End),
+			}
+			if t.Pregap > 0 {
+				tj.Index00 = pmf.LBAToMSFFormatted(t.Start - t.Pregap)
+			}
+			layout.Tracks = append(layout.Tracks, tj)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(layout)
 	}
-}
 
-// gfMult multiplies two non-zero bytes in GF(2^8) using precomputed logarithm tables.
-// Uses the property: a * b = exp(log(a) + log(b)) modulo 255 in GF(2^8).
-// Returns 0 if either input is 0.
-func gfMult(a, b byte) byte {
-	if a == 0 || b == 0 {
-		return 0
+	fmt.Printf("Track  Type   Pregap  Start     End       Sectors\n")
+	total := 0
+	for _, t := range tracks {
+		sectors := t.End - t.Start + 1
+		total += t.SessionGap + t.Pregap + sectors
+		fmt.Printf("%5d  %-5s  %6d  %s  %s  %7d\n", t.Num, t.Type(), t.Pregap,
+			pmf.LBAToMSFFormatted(t.Start), pmf.LBAToMSFFormatted(t.End), sectors)
 	}
-	return gfPow[int(gfLog[a])+int(gfLog[b])]
+	fmt.Printf("Total sectors (including pregaps and session gaps): %d\n", total)
+	toc := pmf.DiscTOC(tracks, pmfOptions(opts))
+	fmt.Printf("Tracks %d-%d, lead-out at sector %d (%s with the lead-in)\n", toc.FirstTrack, toc.LastTrack, toc.LeadOut, toc.LeadOutMSF)
+	fmt.Printf("PMF size %d bytes matches the track table\n", size)
+	return nil
 }
 
-// CD-ROM Mode 2 Form 1 P-Parity Generator using a 2-stage LFSR.
-//
-// Instead of computing the parity formula directly, we simulate a shift register
-// that processes sector data sequentially. The feedback taps correspond to the
-// generator polynomial coefficients.
-//
-// For P-parity (2 parity bytes), the generator polynomial is:
-//   g(x) = x² + g₁x + g₀
-// over GF(2⁸) with the standard CD-ROM field polynomial 0x11d.
-// Feedback coefficients for the LFSR are g₀ = 2 and g₁ = 3.
-//
-// Input:  2064 bytes (header + subheader + data + EDC, header bytes treated as 0)
-// Output: 172 bytes organized as:
-//   Bytes 0-85:   r1 values for all 43 columns (LSB, MSB pairs)
-//   Bytes 86-171: r0 values for all 43 columns (LSB, MSB pairs)
-func pParityLFSR(sector []byte) []byte {
-	if len(sector) != 2064 {
-		panic(fmt.Sprintf("sector wrong size: need 2064 bytes, got %d", len(sector)))
+// roundTrip checks that the image of the premaster pmfPath/ffPath would
+// extract back to the same PMF, without writing it.
+func roundTrip(pmfPath, ffPath string, opts *options) error {
+	in, size, err := openPMF(pmfPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", pmfPath, err)
 	}
+	defer in.Close()
 
-	parity := make([]byte, 172) // 43 columns × 4 bytes
+	tracks, disc, err := parseLayout(ffPath, pmfPath, size, opts)
+	if err != nil {
+		return fmt.Errorf("Failed to parse/validate %s: %v", ffPath, err)
+	}
+	popts := pmfOptions(opts)
+	popts.Disc = disc
+	sectors, err := pmf.RoundTrip(opts.ctx, in, tracks, popts)
+	if err != nil {
+		return fmt.Errorf("Round trip of %s failed: %v", pmfPath, err)
+	}
+	fmt.Printf("Round trip OK: all %d sectors of %s extract back to the same PMF data\n", sectors, pmfPath)
+	return nil
+}
 
-	// Compute parity for each column using LFSR
-	for col := 0; col < 43; col++ {
-		const (
-			g1 = 3 // Feedback coefficient for r1
-			g0 = 2 // Feedback coefficient for r0
-		)
+// pmfSize returns the length of the PMF data in pmfPath, decompressing it
+// once if the archive does not record it.
+func pmfSize(pmfPath string) (int, error) {
+	in, size, err := openPMF(pmfPath)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	if size < 0 {
+		n, err := io.Copy(ioutil.Discard, in)
+		if err != nil {
+			return 0, err
+		}
+		size = int(n)
+	}
+	return size, nil
+}
 
-		var r0Lsb, r0Msb byte
-		var r1Lsb, r1Msb byte
+// plannedFile is a file that a conversion would write, for -dry-run. A
+// negative size means it is only known once written.
+type plannedFile struct {
+	path string
+	size int64
+}
 
-		// Process 24 rows vertically through this column
-		pos := 2*col
-		for row := 0; row < 24; row++ {
-			dataLsb := sector[pos]
-			dataMsb := sector[pos+1]
+// dryRun validates the premaster like a conversion and lists the files it
+// would write, named after base unless -o is given, with their sizes and the
+// free space at the destination, without creating anything.
+func dryRun(pmfPath, ffPath, base string, opts *options) error {
+	size, err := pmfSize(pmfPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", pmfPath, err)
+	}
+	tracks, disc, err := parseLayout(ffPath, pmfPath, size, opts)
+	if err != nil {
+		return fmt.Errorf("Failed to parse/validate %s: %v", ffPath, err)
+	}
+	if opts.logicalPregap {
+		for i := range tracks {
+			tracks[i].LogicalPregap = true
+		}
+	}
+	if opts.output != "" {
+		base = opts.output
+	}
 
-			// Treat header bytes 0-3 as zeros for ECC calculation
-			if pos < 4 {
-				dataLsb = 0
-				if pos < 3 {
-					dataMsb = 0
+	sectors := 0
+	for _, t := range tracks {
+		sectors += t.ImageSectors()
+	}
+	var files []plannedFile
+	if opts.iso {
+		files = append(files, plannedFile{base + ".iso", int64(sectors) * pmf.ISOSector})
+	} else {
+		outBin := base + ".bin"
+		binNames, err := splitFileNames(base, tracks, opts)
+		if err != nil {
+			return err
+		}
+		if binNames != nil {
+			for i, t := range tracks {
+				size := int64(t.ImageSectors()) * sectorBytes(opts)
+				if i > 0 && binNames[i] == binNames[i-1] {
+					files[len(files)-1].size += size
+					continue
+				}
+				if opts.wav && t.Mode == 4 {
+					size += pmf.WAVHeaderSize
 				}
+				files = append(files, plannedFile{binNames[i], size})
 			}
+		} else {
+			binNames = []string{outBin}
+			files = append(files, plannedFile{outBin, int64(sectors) * sectorBytes(opts)})
+		}
 
-			// LFSR feedback and shift operations
-			feedbackLsb := dataLsb ^ r1Lsb
-			feedbackMsb := dataMsb ^ r1Msb
-
-			r1Lsb = r0Lsb ^ gfMult(feedbackLsb, g1)
-			r1Msb = r0Msb ^ gfMult(feedbackMsb, g1)
-			r0Lsb = gfMult(feedbackLsb, g0)
-			r0Msb = gfMult(feedbackMsb, g0)
-
-			pos += 86 // Stride to next row (2 bytes × 43 columns)
+		if opts.toc {
+			files = append(files, plannedFile{base + ".toc", -1})
+		} else if opts.gdi {
+			files = append(files, plannedFile{base + ".gdi", -1})
+		} else {
+			popts := pmfOptions(opts)
+			popts.Disc = disc
+			if opts.remMetadata {
+				popts.CueRem = cueRemarks(pmfPath, tracks, disc.AudioMSB)
+			}
+			var cue bytes.Buffer
+			if err := pmf.WriteCueTo(&cue, tracks, binNames, popts); err != nil {
+				return err
+			}
+			files = append(files, plannedFile{base + ".cue", int64(cue.Len())})
+		}
+		if opts.sub {
+			files = append(files, plannedFile{base + ".sub", int64(sectors) * 96})
+		}
+		if opts.ccd {
+			files = append(files, plannedFile{base + ".ccd", -1})
+		}
+		if opts.chd {
+			files = append(files, plannedFile{base + ".chd", -1})
 		}
+	}
 
-		parity[col*2]      = r1Lsb
-		parity[col*2+1]    = r1Msb
-		parity[86+col*2]   = r0Lsb
-		parity[86+col*2+1] = r0Msb
+	fmt.Printf("Would write:\n")
+	var total int64
+	for _, f := range files {
+		if f.size < 0 {
+			fmt.Printf("  %s (size known once written)\n", f.path)
+			continue
+		}
+		fmt.Printf("  %s (%d bytes)\n", f.path, f.size)
+		total += f.size
+	}
+	if opts.chdOnly {
+		fmt.Printf("  the .bin and cue sheet are deleted once the .chd is written\n")
 	}
+	fmt.Printf("Total: %d bytes (%.1f MiB)\n", total, float64(total)/(1<<20))
 
-	return parity
+	dir := filepath.Dir(base)
+	free, err := freeSpace(dir)
+	if err != nil {
+		fmt.Printf("Free space on %s unknown: %v\n", dir, err)
+		return nil
+	}
+	fmt.Printf("Free space on %s: %d bytes (%.1f MiB)\n", dir, free, float64(free)/(1<<20))
+	if total > free {
+		return fmt.Errorf("%s does not have room for the %d bytes to be written", dir, total)
+	}
+	return nil
 }
 
-// CD-ROM Mode 2 Form 1 Q-Parity Generator using a 2-stage LFSR.
-//
-// Instead of computing the parity formula directly, we simulate a shift register
-// that processes sector data sequentially along diagonals. The feedback taps
-// correspond to the same generator polynomial as P-parity.
-//
-// For Q-parity (2 parity bytes), the generator polynomial is:
-//   g(x) = x² + g₁x + g₀
-// over GF(2⁸) with the standard CD-ROM field polynomial 0x11d.
-// Feedback coefficients for the LFSR are g₀ = 2 and g₁ = 3.
-//
-// Q-parity covers 26 diagonals × 43 elements of interleaved sector data.
-// Diagonals wrap around at byte 2236, following an 88-byte stride pattern.
-//
-// Input:  2236 bytes (header + subheader + data + EDC + P-parity, header bytes treated as 0)
-// Output: 104 bytes organized as follows:
-//   Bytes 0-51:   r1 values for all 26 diagonals (LSB/MSB pairs)
-//   Bytes 52-103: r0 values for all 26 diagonals (LSB/MSB pairs)
-func qParityLFSR(sector []byte) []byte {
-	if len(sector) != 2236 {
-		panic(fmt.Sprintf("sector wrong size: need 2236 bytes, got %d", len(sector)))
+// freeSpace returns the number of bytes available to the user on the volume
+// holding dir, or on its nearest existing parent. It asks the system tools
+// rather than using platform-specific system calls.
+func freeSpace(dir string) (int64, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, err
+	}
+	for !fileExists(dir) && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
 	}
 
-	parity := make([]byte, 104) // 26 diagonals × 4 bytes
-
-	for diag := 0; diag < 26; diag++ {
-		const (
-			g1 = 3 // Feedback coefficient for r1
-			g0 = 2 // Feedback coefficient for r0
-		)
-
-		var r0Lsb, r0Msb byte
-		var r1Lsb, r1Msb byte
-
-		pos := 2 * 43 * diag  // Start of diagonal
-
-		for step := 0; step < 43; step++ {
-			// Wrap diagonal at sector boundary
-			if pos >= 2236 {
-				pos -= 2236
-			}
-
-			dataLsb := sector[pos]
-			dataMsb := sector[pos+1]
+	switch runtime.GOOS {
+	case "windows":
+		root := filepath.VolumeName(dir) + `\`
+		out, err := exec.Command("powershell", "-Command",
+			fmt.Sprintf(`(New-Object System.IO.DriveInfo '%s').AvailableFreeSpace`, root)).Output()
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	default:
+		// POSIX output: a header, then "filesystem blocks used available ..."
+		out, err := exec.Command("df", "-Pk", dir).Output()
+		if err != nil {
+			return 0, err
+		}
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		var fields []string
+		if len(lines) >= 2 {
+			fields = strings.Fields(lines[len(lines)-1])
+		}
+		if len(fields) < 4 {
+			return 0, fmt.Errorf("unexpected df output %q", out)
+		}
+		kb, err := strconv.ParseInt(fields[3], 10, 64)
+		return kb * 1024, err
+	}
+}
 
-			// Treat header bytes 0-3 as zeros for ECC calculation
-			if pos < 4 {
-				dataLsb = 0
-				if pos < 3 {
-					dataMsb = 0
-				}
-			}
+// progressPrinter returns a Progress callback that keeps a percentage on the
+// current line of w, redrawing it only when it changes.
+func progressPrinter(w io.Writer) func(done, total int) {
+	last := -1
+	return func(done, total int) {
+		if total <= 0 {
+			return
+		}
+		pct := done * 100 / total
+		if pct == last {
+			return
+		}
+		last = pct
+		// Back at the start of the line, so the next log line overwrites it
+		fmt.Fprintf(w, "\r%3d%%\r", pct)
+	}
+}
 
-			// LFSR feedback and shift operations
-			feedbackLsb := dataLsb ^ r1Lsb
-			feedbackMsb := dataMsb ^ r1Msb
+// isTerminal reports whether f is a terminal rather than a file, pipe or
+// the null device (which is a character device too).
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(fi, null)
+}
 
-			r1Lsb = r0Lsb ^ gfMult(feedbackLsb, g1)
-			r1Msb = r0Msb ^ gfMult(feedbackMsb, g1)
-			r0Lsb = gfMult(feedbackLsb, g0)
-			r0Msb = gfMult(feedbackMsb, g0)
+func pauseOnExit() {
+	// On stderr, so a BIN image written to stdout stays intact
+	fmt.Fprintln(os.Stderr, "\nPress Enter to exit...")
+	bufio.NewReader(os.Stdin).ReadBytes('\n')
+}
 
-			pos += 88 // Diagonal stride (2 bytes × 44 positions)
+func setConsoleTitle(title string) {
+	switch runtime.GOOS {
+	case "windows":
+		// Use CMD method; works in both CMD and PowerShell
+		cmd := exec.Command("cmd", "/C", "title", title)
+		cmd.Run() // ignore errors for simplicity
+	case "linux", "darwin":
+		// ANSI escape sequence for most terminals, unless stdout is
+		// redirected (possibly carrying the BIN image)
+		if isTerminal(os.Stdout) {
+			fmt.Printf("\033]0;%s\007", title)
 		}
-
-		parity[diag*2]      = r1Lsb
-		parity[diag*2+1]    = r1Msb
-		parity[52+diag*2]   = r0Lsb
-		parity[52+diag*2+1] = r0Msb
 	}
-
-	return parity
 }
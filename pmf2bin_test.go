@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// copyPremaster copies pmf/testdata/small.pmf and its .pmf.ff to dir and
+// returns the path of the copied PMF.
+func copyPremaster(t *testing.T, dir string) string {
+	for _, name := range []string{"small.pmf", "small.pmf.ff"} {
+		data, err := ioutil.ReadFile(filepath.Join("pmf", "testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "small.pmf")
+}
+
+// TestFailedConversionRestoresOutputs makes the cue sheet of a conversion
+// fail after its BIN image is in place, over an older .bin and .cue, and
+// checks that both are put back.
+func TestFailedConversionRestoresOutputs(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "pmf2bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		pmfPath := copyPremaster(t, dir)
+		binPath, cuePath := filepath.Join(dir, "small.bin"), filepath.Join(dir, "small.cue")
+		old := map[string][]byte{binPath: []byte("old image"), cuePath: []byte("old cue sheet")}
+		for path, data := range old {
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The cue sheet's temporary file cannot be created over a directory
+		if err := os.Mkdir(cuePath+".tmp", 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		args := []string{"-quiet", "-rem-metadata=false"}
+		if keep {
+			args = append(args, "-keep-partial")
+		}
+		if err := run(append(args, pmfPath)); err == nil {
+			t.Fatalf("keep %v: conversion succeeded", keep)
+		}
+		for path, want := range old {
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Errorf("keep %v: %v", keep, err)
+			} else if !bytes.Equal(got, want) {
+				t.Errorf("keep %v: %s holds %d new bytes, want %q", keep, filepath.Base(path), len(got), want)
+			}
+			if _, err := os.Stat(path + ".old"); err == nil {
+				t.Errorf("keep %v: %s.old left behind", keep, filepath.Base(path))
+			}
+		}
+		// The new image is kept under its temporary name only with -keep-partial
+		if _, err := os.Stat(binPath + ".tmp"); (err == nil) != keep {
+			t.Errorf("keep %v: small.bin.tmp exists: %v", keep, err == nil)
+		}
+	}
+}
+
+func TestConversionReplacesOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmf2bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pmfPath := copyPremaster(t, dir)
+	binPath := filepath.Join(dir, "small.bin")
+	if err := ioutil.WriteFile(binPath, []byte("old image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run([]string{"-quiet", "-rem-metadata=false", pmfPath}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(binPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(filepath.Join("pmf", "testdata", "small.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("small.bin was not replaced by the new image")
+	}
+	if _, err := os.Stat(binPath + ".old"); err == nil {
+		t.Error("small.bin.old left behind")
+	}
+}
+
+// premasterTest is a premasterPaths case: the files in the directory, the
+// argument, and the names expected back, or a part of the error.
+type premasterTest struct {
+	files      []string
+	arg        string
+	pmf, ff    string
+	errMessage string
+}
+
+// checkPremasterPaths runs each test in a directory of its own holding empty
+// files, except header.pmf, which is given a layout header.
+func checkPremasterPaths(t *testing.T, tests []premasterTest) {
+	header, err := ioutil.ReadFile(filepath.Join("pmf", "testdata", "header.pmf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "pmf2bin-paths")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for _, name := range tt.files {
+			var data []byte
+			if name == "header.pmf" {
+				data = header
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pmfPath, ffPath, err := premasterPaths(filepath.Join(dir, tt.arg))
+		if tt.errMessage != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.errMessage) {
+				t.Errorf("%s with %v: error %v, want one containing %q", tt.arg, tt.files, err, tt.errMessage)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s with %v: %v", tt.arg, tt.files, err)
+			continue
+		}
+		if pmfPath != filepath.Join(dir, tt.pmf) || ffPath != filepath.Join(dir, tt.ff) {
+			t.Errorf("%s with %v: %s, %s, want %s, %s", tt.arg, tt.files, filepath.Base(pmfPath), filepath.Base(ffPath), tt.pmf, tt.ff)
+		}
+	}
+}
+
+func TestPremasterPaths(t *testing.T) {
+	pair := []string{"game.pmf", "game.pmf.ff"}
+	checkPremasterPaths(t, []premasterTest{
+		{files: pair, arg: "game.pmf", pmf: "game.pmf", ff: "game.pmf.ff"},
+		{files: pair, arg: "game.pmf.ff", pmf: "game.pmf", ff: "game.pmf.ff"},
+		{files: pair, arg: "game", pmf: "game.pmf", ff: "game.pmf.ff"},
+		{files: []string{"game.pmf.gz", "game.pmf.ff"}, arg: "game.pmf.ff", pmf: "game.pmf.gz", ff: "game.pmf.ff"},
+		{files: []string{"header.pmf"}, arg: "header.pmf", pmf: "header.pmf", ff: "header.pmf"},
+		{files: pair, arg: "game.bin", errMessage: "game.bin is not a .pmf or .pmf.ff file"},
+		{files: pair, arg: "other", errMessage: "other is not a .pmf or .pmf.ff file"},
+		{files: pair, arg: "other.pmf", errMessage: "other.pmf not found"},
+		{files: pair, arg: "other.pmf.ff", errMessage: "other.pmf.ff not found"},
+		{files: []string{"game.pmf"}, arg: "game.pmf", errMessage: "game.pmf.ff"},
+		{files: []string{"game.pmf.ff"}, arg: "game.pmf.ff", errMessage: "has no matching"},
+	})
+}
+
+func TestPremasterPathsFF(t *testing.T) {
+	checkPremasterPaths(t, []premasterTest{
+		{files: []string{"game.pmf", "game.ff"}, arg: "game.pmf", pmf: "game.pmf", ff: "game.ff"},
+		{files: []string{"game.pmf", "game.ff"}, arg: "game.ff", pmf: "game.pmf", ff: "game.ff"},
+		{files: []string{"game.pmf", "game.ff"}, arg: "game", pmf: "game.pmf", ff: "game.ff"},
+		{files: []string{"game.pmf", "game.pmf.ff", "game.ff"}, arg: "game.pmf", pmf: "game.pmf", ff: "game.pmf.ff"},
+		{files: []string{"game.pmf", "game.pmf.ff", "game.ff"}, arg: "game.ff", pmf: "game.pmf", ff: "game.ff"},
+		{files: []string{"GAME.PMF", "GAME.FF"}, arg: "GAME.PMF", pmf: "GAME.PMF", ff: "GAME.FF"},
+		{files: []string{"GAME.PMF", "GAME.FF"}, arg: "GAME.FF", pmf: "GAME.PMF", ff: "GAME.FF"},
+		{files: []string{"game.pmf.zip", "game.ff"}, arg: "game.ff", pmf: "game.pmf.zip", ff: "game.ff"},
+		{files: []string{"game.pmf"}, arg: "game.pmf", errMessage: "game.pmf.ff or "},
+		{files: []string{"game.ff"}, arg: "game.ff", errMessage: "has no matching"},
+	})
+}